@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AccessLog configures the log of proxied requests, in Combined Log Format
+// (the default) or as JSON lines.
+type AccessLog struct {
+	LogFile
+	Format string `json:"format,omitempty"` // "combined" or "json"
+}
+
+type accessLogger struct {
+	out    *rotatingFile
+	format string
+}
+
+// Opened by loadConfig, guarded by cfgMu; nil when access_log isn't set
+var accessLog *accessLogger
+
+// requestInfo collects what the access log needs to know about a request as
+// it is handled.
+type requestInfo struct {
+	ID       string
+	User     string
+	Upstream string
+	Proxy    *ProxyDetails
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the request's info, or a throwaway one outside the
+// access log middleware.
+func requestInfoFrom(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// newAccessLogger opens the log for conf, or returns nil when it isn't set.
+func newAccessLogger(logs *logFileSet, conf *AccessLog, defaultName string) (*accessLogger, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	switch conf.Format {
+	case "", "combined", "json":
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", conf.Format)
+	}
+	return &accessLogger{out: logs.open(conf.LogFile, defaultName), format: conf.Format}, nil
+}
+
+// Incoming request IDs are kept when they look like one
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// instrumentRequests gives every request an ID, forwarded upstream and
+// returned to the client as X-Request-ID, and logs and counts it once handled.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = generateState()
+		}
+		r.Header.Set("X-Request-ID", id)
+		w.Header().Set("X-Request-ID", id)
+
+		info := &requestInfo{ID: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		r, span := startServerSpan(r, serverSpanName(r))
+		span.setAttr("http.request.method", r.Method)
+		span.setAttr("url.path", r.URL.Path)
+		span.setAttr("server.address", r.Host)
+		span.setAttr("client.address", clientIP(r).String())
+		span.setAttr("pylon.request_id", id)
+		lw := &loggingResponseWriter{ResponseWriter: w, info: info}
+
+		next.ServeHTTP(lw, r)
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.setAttr("http.response.status_code", status)
+		if info.User != "" {
+			span.setAttr("enduser.id", info.User)
+		}
+		if status >= 500 {
+			span.setError(fmt.Errorf("HTTP %d", status))
+		}
+		span.end()
+		if lw.hijacked {
+			// The upgraded connection has been closed by now
+			websocketConnections.add(-1, metricsProxyLabel(info))
+		}
+		observeRequest(r, info, status, time.Since(start))
+
+		logger := info.Proxy.accessLogger()
+		if logger == nil {
+			return
+		}
+		if _, err := logger.out.Write(logger.line(r, info, lw, time.Since(start))); err != nil {
+			log.Printf("Failed to write access log: %v", err)
+		}
+	})
+}
+
+// accessLogger returns the proxy's own access log if it has one, otherwise
+// the global one.
+func (pd *ProxyDetails) accessLogger() *accessLogger {
+	if pd != nil && pd.AccessLog != nil {
+		return pd.AccessLog
+	}
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return accessLog
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Address   string    `json:"address"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	Upstream  string    `json:"upstream,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// line renders one log line. Combined lines carry the host, request ID,
+// latency and upstream after the standard fields.
+func (l *accessLogger) line(r *http.Request, info *requestInfo, lw *loggingResponseWriter, latency time.Duration) []byte {
+	now := time.Now()
+	status := lw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if l.format == "json" {
+		line, _ := json.Marshal(accessLogEntry{
+			Time:      now.UTC(),
+			RequestID: info.ID,
+			TraceID:   traceIDFromRequest(r),
+			Address:   clientIP(r).String(),
+			Host:      r.Host,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Protocol:  r.Proto,
+			Status:    status,
+			Bytes:     lw.bytes,
+			LatencyMS: float64(latency.Microseconds()) / 1000,
+			Upstream:  info.Upstream,
+			User:      info.User,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+		return append(line, '\n')
+	}
+
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %q %q %s %s %.3f %s\n",
+		clientIP(r),
+		orDash(info.User),
+		now.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, escapeLogField(r.URL.RequestURI()), r.Proto,
+		status,
+		lw.bytes,
+		orDash(r.Referer()),
+		orDash(r.UserAgent()),
+		orDash(r.Host),
+		info.ID,
+		latency.Seconds(),
+		orDash(info.Upstream),
+	))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeLogField keeps client supplied values from breaking up a log line.
+func escapeLogField(s string) string {
+	return strings.NewReplacer(`"`, `\"`, "\n", `\n`, "\r", `\r`, " ", "%20").Replace(s)
+}
+
+// loggingResponseWriter records the status and size of a response, passing
+// flushes and websocket hijacks through to the underlying writer.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	info     *requestInfo
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (lw *loggingResponseWriter) WriteHeader(status int) {
+	if lw.status == 0 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+func (lw *loggingResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (lw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := lw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if lw.status == 0 {
+		lw.status = http.StatusSwitchingProtocols
+	}
+	lw.hijacked = true
+	websocketConnections.inc(metricsProxyLabel(lw.info))
+	return conn, rw, nil
+}
+
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessRequest is a denied user's request to be added to a proxy's allowed
+// users, pending an admin decision.
+type AccessRequest struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Host      string    `json:"host"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	Status    string    `json:"status"` // "pending", "approved" or "denied"
+	DecidedAt time.Time `json:"decided_at"`
+}
+
+var (
+	accessRequestsMu sync.Mutex
+	accessRequests   []*AccessRequest
+)
+
+func loadAccessRequests() error {
+	f, err := os.ReadFile(getDataPath("access_requests.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var loaded []*AccessRequest
+	if err := json.Unmarshal(f, &loaded); err != nil {
+		return err
+	}
+
+	accessRequestsMu.Lock()
+	accessRequests = loaded
+	accessRequestsMu.Unlock()
+	return nil
+}
+
+// saveAccessRequestsLocked writes the requests to disk. accessRequestsMu must
+// be held.
+func saveAccessRequestsLocked() error {
+	pretty, err := json.MarshalIndent(accessRequests, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getDataPath("access_requests.json"), pretty, 0600)
+}
+
+// writeUnauthorizedPage tells a logged in user they aren't allowed on this
+// proxy and offers to request access from the admins.
+func writeUnauthorizedPage(w http.ResponseWriter, r *http.Request, pd *ProxyDetails, id authIdentity) {
+	if pd.RoutePolicy {
+		writePylonPage(w, http.StatusForbidden, "Pylon Unauthorized", fmt.Sprintf("User %s is unauthorized to access this resource. Ask an admin for access to it.", id.Email), `
+			<a href="/pylon/login" class="login-btn" style="background-color: #334155;">Login</a>
+		`)
+		return
+	}
+	writePylonPage(w, http.StatusForbidden, "Pylon Unauthorized", fmt.Sprintf("User %s is unauthorized to access this resource.", id.Email), fmt.Sprintf(`
+		<form method="POST" action="/pylon/access-request">
+			<input type="hidden" name="host" value="%s">
+			%s
+			<textarea class="pylon-input" name="reason" rows="3" placeholder="Why do you need access?"></textarea>
+			<button class="login-btn" type="submit" style="background-color: #4f46e5;">Request access</button>
+		</form>
+		<a href="/pylon/login" class="login-btn" style="background-color: #334155;">Login</a>
+	`, html.EscapeString(r.Host), csrfField(id)))
+}
+
+// accessRequestHandler records a logged in user's request for access to a
+// proxy and notifies the admins.
+func accessRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionStore := getSessionStore()
+	session, _ := sessionStore.Get(r, "pylon")
+	email, _ := session.Values["email"].(string)
+	if email == "" {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(w, r, sessionIdentity(w, r, session)) {
+		return
+	}
+
+	pd, found := lookupProxy(r.FormValue("host"))
+	if !found {
+		http.Error(w, "Proxy Host Not Found", http.StatusNotFound)
+		return
+	}
+	// Aliases and wildcard hosts are granted on the proxy they belong to
+	host := pd.External
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if len(reason) > 1000 {
+		reason = reason[:1000]
+	}
+
+	accessRequestsMu.Lock()
+	var req *AccessRequest
+	for _, existing := range accessRequests {
+		if existing.Status == "pending" && existing.Email == email && existing.Host == host {
+			// Don't notify twice for the same pending request
+			existing.Reason = reason
+			req = existing
+			break
+		}
+	}
+	isNew := req == nil
+	if isNew {
+		req = &AccessRequest{
+			ID:        generateState()[:12],
+			Email:     email,
+			Host:      host,
+			Reason:    reason,
+			CreatedAt: time.Now(),
+			Status:    "pending",
+		}
+		accessRequests = append(accessRequests, req)
+	}
+	err := saveAccessRequestsLocked()
+	reqCopy := *req
+	accessRequestsMu.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to save access requests: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("user %s requested access to %s", email, host)
+	if isNew {
+		go notifyAdmins(fmt.Sprintf("%s requested access to %s: %s", reqCopy.Email, reqCopy.Host, reqCopy.Reason), reqCopy)
+	}
+
+	writePylonPage(w, http.StatusOK, "Pylon Access Request", "Your request has been sent to the administrators.", "")
+}
+
+// notifyAdmins posts an event to the configured admin webhook. The "text"
+// field makes the payload usable as a Slack or Mattermost incoming webhook.
+func notifyAdmins(text string, event interface{}) {
+	cfgMu.RLock()
+	webhook := cfg.AdminNotifyWebhook
+	cfgMu.RUnlock()
+	if webhook == "" {
+		return
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"text":  text,
+		"event": event,
+	})
+	if err != nil {
+		log.Printf("Failed to encode admin notification: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		// Without the URL, which is a secret
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		log.Printf("Failed to notify admins: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Admin notification webhook returned status %d", resp.StatusCode)
+	}
+}
+
+// AccessRequestsHandler lets admins list access requests and approve or deny
+// them. Approving adds the user to the proxy's allowed users.
+func AccessRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	enableAdminCORS(&w, r)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	admin := adminFromRequest(r)
+
+	if r.Method == "GET" {
+		status := r.URL.Query().Get("status")
+		accessRequestsMu.Lock()
+		list := []AccessRequest{}
+		for _, req := range accessRequests {
+			// Delegated admins only see requests for their own proxies
+			if admin.Role == adminRoleDelegated && !admin.canManageUsersOf(req.Host) {
+				continue
+			}
+			if status == "" || req.Status == status {
+				list = append(list, *req)
+			}
+		}
+		accessRequestsMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	if r.Method == "POST" {
+		id := r.URL.Query().Get("id")
+		action := r.URL.Query().Get("action")
+		if action != "approve" && action != "deny" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		// Optional time limit for the grant, e.g. duration=72h
+		var duration time.Duration
+		if d := r.URL.Query().Get("duration"); d != "" {
+			var err error
+			if duration, err = time.ParseDuration(d); err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		accessRequestsMu.Lock()
+		defer accessRequestsMu.Unlock()
+
+		var req *AccessRequest
+		for _, candidate := range accessRequests {
+			if candidate.ID == id {
+				req = candidate
+				break
+			}
+		}
+		if req == nil || req.Status != "pending" {
+			http.Error(w, "Access Request Not Found", http.StatusNotFound)
+			return
+		}
+		if !admin.canManageUsersOf(req.Host) {
+			writeAdminForbidden(w, admin)
+			return
+		}
+
+		if action == "approve" {
+			if err := grantProxyAccess(req.Host, req.Email, duration, adminActor(r, "access request "+req.ID+" approved")); err != nil {
+				log.Printf("Failed to approve access request %s: %v", req.ID, err)
+				http.Error(w, "Failed to apply configuration internally", http.StatusInternalServerError)
+				return
+			}
+			req.Status = "approved"
+		} else {
+			req.Status = "denied"
+		}
+		req.DecidedAt = time.Now()
+		if err := saveAccessRequestsLocked(); err != nil {
+			log.Printf("Failed to save access requests: %v", err)
+		}
+		log.Printf("access request %s of %s for %s %s", req.ID, req.Email, req.Host, req.Status)
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("okay"))
+		return
+	}
+
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
+
+// grantProxyAccess adds the user to the allowed users of the proxy serving
+// host, saving the config like a POST to /config would. A non-zero duration
+// makes it a time-bound grant.
+func grantProxyAccess(host string, email string, duration time.Duration, actor configActor) error {
+	grant := AllowedUser{Email: email}
+	if duration > 0 {
+		expires := time.Now().Add(duration)
+		grant.Expires = &expires
+	}
+
+	return updateConfig(actor, func(conf *Config) error {
+		for i := range conf.Proxies {
+			if conf.Proxies[i].External != host {
+				continue
+			}
+			users := conf.Proxies[i].AllowedUsers[:0]
+			for _, u := range conf.Proxies[i].AllowedUsers {
+				if u.Email != email {
+					users = append(users, u)
+				}
+			}
+			conf.Proxies[i].AllowedUsers = append(users, grant)
+			return nil
+		}
+		return fmt.Errorf("proxy %q no longer exists", host)
+	})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// OAuth based admin login. The admin panel runs on its own listener, which
+// can't read the proxy's secure session cookie, so admins log in through the
+// normal gateway on the proxy host and are handed over to the admin panel
+// with a short-lived one-time code that is exchanged for an admin session.
+
+const adminHandoffLifetime = time.Minute
+
+type adminHandoff struct {
+	Email     string
+	ExpiresAt time.Time
+}
+
+type adminCtxKey struct{}
+
+var (
+	adminHandoffsMu sync.Mutex
+	adminHandoffs   = make(map[string]adminHandoff)
+)
+
+// getAdminURL is the base URL the admin panel is reached at.
+func getAdminURL() string {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	if cfg.AdminURL != "" {
+		return strings.TrimSuffix(cfg.AdminURL, "/")
+	}
+	return "http://" + cfg.TLDN + ":3001"
+}
+
+// adminOrigin is the admin panel's origin, as browsers send it in the Origin
+// header of requests from its pages.
+func adminOrigin() string {
+	u, err := url.Parse(getAdminURL())
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// enableAdminCORS lets the admin panel's own origin call the admin API with
+// its cookie. Proxied apps on sibling hosts of the TLDN are sent the Lax
+// admin cookie too, so no other origin may read the responses.
+func enableAdminCORS(w *http.ResponseWriter, r *http.Request) {
+	(*w).Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin == "" || origin != adminOrigin() {
+		return
+	}
+	(*w).Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	(*w).Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+// Admin roles, from most to least privileged. Delegated admins may only
+// change the allowed users of the proxies listed for them.
+const (
+	adminRoleOwner     = "owner"
+	adminRoleEditor    = "editor"
+	adminRoleViewer    = "viewer"
+	adminRoleDelegated = "delegated"
+)
+
+// AdminEntry is an admins entry of the config. It is written as a plain email
+// for owners, or as an object giving the role:
+//
+//	{"email": "lead@example.com", "role": "delegated", "proxies": ["wiki.example.com"]}
+type AdminEntry struct {
+	Email   string   `json:"email"`
+	Role    string   `json:"role"`
+	Proxies []string `json:"proxies,omitempty"`
+}
+
+func (a AdminEntry) MarshalJSON() ([]byte, error) {
+	if a.Role == adminRoleOwner && len(a.Proxies) == 0 {
+		return json.Marshal(a.Email)
+	}
+	type adminEntry AdminEntry
+	return json.Marshal(adminEntry(a))
+}
+
+func (a *AdminEntry) UnmarshalJSON(b []byte) error {
+	var email string
+	if err := json.Unmarshal(b, &email); err == nil {
+		*a = AdminEntry{Email: email, Role: adminRoleOwner}
+		return nil
+	}
+	type adminEntry AdminEntry
+	if err := json.Unmarshal(b, (*adminEntry)(a)); err != nil {
+		return err
+	}
+	switch a.Role {
+	case adminRoleOwner, adminRoleEditor, adminRoleViewer, adminRoleDelegated:
+		return nil
+	case "":
+		a.Role = adminRoleOwner
+		return nil
+	}
+	return fmt.Errorf("unknown admin role %q for %s", a.Role, a.Email)
+}
+
+// canEdit reports whether the admin may change proxies and users.
+func (a AdminEntry) canEdit() bool {
+	return a.Role == adminRoleOwner || a.Role == adminRoleEditor
+}
+
+// canManageUsersOf reports whether the admin may change who can access the
+// proxy serving host.
+func (a AdminEntry) canManageUsersOf(host string) bool {
+	return a.canEdit() || (a.Role == adminRoleDelegated && sliceContains(a.Proxies, host))
+}
+
+// seesProxy reports whether the admin may see the tokens, events and audit
+// entries of the proxy with this external host.
+func (a AdminEntry) seesProxy(external string) bool {
+	return a.Role != adminRoleDelegated || sliceContains(a.Proxies, external)
+}
+
+func lookupAdmin(email string) (AdminEntry, bool) {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	if email == "" {
+		return AdminEntry{}, false
+	}
+	for _, a := range cfg.Admins {
+		if strings.EqualFold(a.Email, email) {
+			return a, true
+		}
+	}
+	return AdminEntry{}, false
+}
+
+func isAdmin(email string) bool {
+	_, found := lookupAdmin(email)
+	return found
+}
+
+// adminFromRequest returns who is using the admin panel. The basic auth
+// account and onboarding mode act as owners.
+func adminFromRequest(r *http.Request) AdminEntry {
+	admin, _ := r.Context().Value(adminCtxKey{}).(AdminEntry)
+	return admin
+}
+
+func withAdmin(r *http.Request, admin AdminEntry) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminCtxKey{}, admin))
+}
+
+func writeAdminForbidden(w http.ResponseWriter, admin AdminEntry) {
+	log.Printf("admin %s (%s) denied", admin.Email, admin.Role)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// redactConfig blanks the secrets non-owners aren't shown.
+func redactConfig(conf Config) Config {
+	conf.SessionKey = ""
+	conf.AdminPasswordHash = ""
+	conf.OAuth.Client_Secret = ""
+	conf.AdminNotifyWebhook = ""
+	providers := make(map[string]OAuthProvider)
+	for key, p := range conf.OAuthProviders {
+		p.ClientSecret = ""
+		providers[key] = p
+	}
+	conf.OAuthProviders = providers
+	return conf
+}
+
+func sameJSON(a, b interface{}) bool {
+	aj, aErr := json.Marshal(a)
+	bj, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aj) == string(bj)
+}
+
+// serverPaths lists the directories and files on the server a proxy uses.
+func serverPaths(static *StaticSite, accessLog *AccessLog, routes []Route) string {
+	var paths []string
+	if static != nil {
+		paths = append(paths, "static "+static.Root)
+	}
+	if accessLog != nil && accessLog.Path != "" {
+		paths = append(paths, "access_log "+accessLog.Path)
+	}
+	for _, route := range routes {
+		if route.Static != nil {
+			paths = append(paths, "route static "+route.Static.Root)
+		}
+	}
+	return strings.Join(paths, "\n")
+}
+
+// authorizeConfigChange checks that a config posted by a non-owner only
+// changes what their role allows. Secrets they were shown redacted are
+// restored from the current config.
+func authorizeConfigChange(admin AdminEntry, current Config, submitted *Config) error {
+	if admin.Role == adminRoleOwner {
+		return nil
+	}
+	if admin.Role != adminRoleEditor && admin.Role != adminRoleDelegated {
+		return errors.New("read-only admin")
+	}
+
+	if submitted.SessionKey == "" {
+		submitted.SessionKey = current.SessionKey
+	}
+	if submitted.OAuth.Client_Secret == "" {
+		submitted.OAuth.Client_Secret = current.OAuth.Client_Secret
+	}
+	if submitted.AdminNotifyWebhook == "" {
+		submitted.AdminNotifyWebhook = current.AdminNotifyWebhook
+	}
+	for key, p := range submitted.OAuthProviders {
+		if currentProvider, found := current.OAuthProviders[key]; found && p.ClientSecret == "" {
+			p.ClientSecret = currentProvider.ClientSecret
+			submitted.OAuthProviders[key] = p
+		}
+	}
+
+	// Everything but the proxies and users has to stay the same
+	rest := *submitted
+	rest.Proxies = current.Proxies
+	rest.AllowedUsers = current.AllowedUsers
+	rest.OAuth = current.OAuth // not editable from the admin panel
+	if rest.AdminPasswordHash == "" {
+		rest.AdminPasswordHash = current.AdminPasswordHash
+	}
+	if !sameJSON(rest, current) {
+		return errors.New("only proxies and users may be changed")
+	}
+
+	// Static roots and log paths name files on the server, so only owners
+	// may set them: a static root of "/" would serve config.json
+	currentPaths := make(map[string]string)
+	for _, p := range current.Proxies {
+		currentPaths[p.External] = serverPaths(p.Static, p.AccessLog, p.Routes)
+	}
+	for _, p := range submitted.Proxies {
+		if serverPaths(p.Static, p.AccessLog, p.Routes) != currentPaths[p.External] {
+			return fmt.Errorf("static sites and access log paths of %s may only be changed by owners", p.External)
+		}
+	}
+
+	if admin.Role == adminRoleEditor {
+		return nil
+	}
+
+	// Delegated admins may only change allowed users of their own proxies
+	if !sameJSON(submitted.AllowedUsers, current.AllowedUsers) {
+		return errors.New("global allowed users may not be changed")
+	}
+	if len(submitted.Proxies) != len(current.Proxies) {
+		return errors.New("proxies may not be added or removed")
+	}
+	for i := range submitted.Proxies {
+		proxy := submitted.Proxies[i]
+		proxy.AllowedUsers = current.Proxies[i].AllowedUsers
+		if !sameJSON(proxy, current.Proxies[i]) {
+			return fmt.Errorf("proxy %s may not be changed", current.Proxies[i].External)
+		}
+		if !sameJSON(submitted.Proxies[i].AllowedUsers, current.Proxies[i].AllowedUsers) && !admin.canManageUsersOf(current.Proxies[i].External) {
+			return fmt.Errorf("allowed users of %s may not be changed", current.Proxies[i].External)
+		}
+	}
+	return nil
+}
+
+// adminLoginHandler runs on the proxy host: once the user is logged in and
+// listed in admins, it hands them over to the admin panel.
+func adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	sessionStore := getSessionStore()
+	session, _ := sessionStore.Get(r, "pylon")
+	email, _ := session.Values["email"].(string)
+	if email == "" {
+		redirectToLogin(w, r)
+		return
+	}
+
+	if !isAdmin(email) {
+		log.Printf("user %s attempted to log in to the admin panel", email)
+		writePylonPage(w, http.StatusForbidden, "Pylon Admin", fmt.Sprintf("User %s is not a Pylon administrator.", email), "")
+		return
+	}
+
+	code := generateState()
+	if code == "" {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	adminHandoffsMu.Lock()
+	for c, h := range adminHandoffs {
+		if time.Now().After(h.ExpiresAt) {
+			delete(adminHandoffs, c)
+		}
+	}
+	adminHandoffs[code] = adminHandoff{Email: email, ExpiresAt: time.Now().Add(adminHandoffLifetime)}
+	adminHandoffsMu.Unlock()
+
+	http.Redirect(w, r, getAdminURL()+"/admin-callback?code="+code, http.StatusFound)
+}
+
+func getAdminSession(r *http.Request) *sessions.Session {
+	session, _ := getSessionStore().Get(r, "pylon_admin")
+	return session
+}
+
+// AdminCallbackHandler runs on the admin listener and exchanges a handoff
+// code for an admin session.
+func AdminCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+
+	adminHandoffsMu.Lock()
+	handoff, found := adminHandoffs[code]
+	delete(adminHandoffs, code)
+	adminHandoffsMu.Unlock()
+
+	if !found || time.Now().After(handoff.ExpiresAt) || !isAdmin(handoff.Email) {
+		http.Error(w, "Invalid or expired admin login", http.StatusUnauthorized)
+		return
+	}
+
+	cfgMu.RLock()
+	maxAge := int(cfg.CookieExpire.Seconds())
+	cfgMu.RUnlock()
+	if maxAge <= 0 {
+		maxAge = int((12 * time.Hour).Seconds())
+	}
+
+	session := getAdminSession(r)
+	session.Values["admin_email"] = handoff.Email
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(getAdminURL(), "https://"),
+		// Lax, since the login arrives by redirect from the gateway: a
+		// Strict cookie isn't sent on the redirect to the panel that follows
+		SameSite: http.SameSiteLaxMode,
+	}
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("admin %s logged in to the admin panel from %s", handoff.Email, clientIP(r))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// AdminLogoutHandler ends the admin session.
+func AdminLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	session := getAdminSession(r)
+	session.Options = &sessions.Options{Path: "/", MaxAge: -1, HttpOnly: true}
+	session.Save(r, w)
+
+	cfgMu.RLock()
+	tldn := cfg.TLDN
+	cfgMu.RUnlock()
+	http.Redirect(w, r, "https://"+tldn+"/pylon/login", http.StatusFound)
+}
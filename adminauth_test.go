@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAdminConfig = `{
+	"tldn": "example.com",
+	"session_key": "secret",
+	"admin_notify_webhook": "https://hooks.example.com/secret",
+	"oauth_providers": {"google": {"id": "google", "type": "google", "client_id": "id", "client_secret": "secret"}},
+	"proxies": [
+		{"external": "wiki.example.com", "internal": "http://wiki:8080", "allowed_users": ["alice@example.com"]},
+		{"external": "docs.example.com", "static": {"root": "/srv/docs"}, "allowed_users": ["alice@example.com"]}
+	]
+}`
+
+// editConfig returns the test config with edit applied to its JSON form.
+func editConfig(t *testing.T, edit func(map[string]interface{})) Config {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(testAdminConfig), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if edit != nil {
+		edit(raw)
+	}
+	b, _ := json.Marshal(raw)
+	var conf Config
+	if err := json.Unmarshal(b, &conf); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func proxyAt(raw map[string]interface{}, i int) map[string]interface{} {
+	return raw["proxies"].([]interface{})[i].(map[string]interface{})
+}
+
+func TestAuthorizeConfigChange(t *testing.T) {
+	owner := AdminEntry{Email: "owner@example.com", Role: adminRoleOwner}
+	editor := AdminEntry{Email: "editor@example.com", Role: adminRoleEditor}
+	viewer := AdminEntry{Email: "viewer@example.com", Role: adminRoleViewer}
+	delegated := AdminEntry{Email: "lead@example.com", Role: adminRoleDelegated, Proxies: []string{"wiki.example.com"}}
+
+	addUser := func(i int) func(map[string]interface{}) {
+		return func(raw map[string]interface{}) {
+			p := proxyAt(raw, i)
+			p["allowed_users"] = append(p["allowed_users"].([]interface{}), "bob@example.com")
+		}
+	}
+	addProxy := func(proxy map[string]interface{}) func(map[string]interface{}) {
+		return func(raw map[string]interface{}) {
+			raw["proxies"] = append(raw["proxies"].([]interface{}), proxy)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		admin AdminEntry
+		edit  func(map[string]interface{})
+		err   string // part of the error, or "" when allowed
+	}{
+		{"owner changes settings", owner, func(raw map[string]interface{}) { raw["session_key"] = "new" }, ""},
+		{"owner adds static site", owner, addProxy(map[string]interface{}{"external": "files.example.com", "static": map[string]interface{}{"root": "/"}}), ""},
+		{"viewer", viewer, addUser(0), "read-only"},
+		{"editor adds user", editor, addUser(1), ""},
+		{"editor adds proxy", editor, addProxy(map[string]interface{}{"external": "new.example.com", "internal": "http://new:80"}), ""},
+		{"editor changes session key", editor, func(raw map[string]interface{}) { raw["session_key"] = "new" }, "only proxies and users"},
+		{"editor changes webhook", editor, func(raw map[string]interface{}) { raw["admin_notify_webhook"] = "https://evil.example.com" }, "only proxies and users"},
+		{"editor submits redacted secrets", editor, func(raw map[string]interface{}) {
+			raw["session_key"] = ""
+			raw["admin_notify_webhook"] = ""
+			raw["oauth_providers"].(map[string]interface{})["google"].(map[string]interface{})["client_secret"] = ""
+		}, ""},
+		{"editor adds static site", editor, addProxy(map[string]interface{}{"external": "files.example.com", "static": map[string]interface{}{"root": "/"}}), "only be changed by owners"},
+		{"editor moves static root", editor, func(raw map[string]interface{}) {
+			proxyAt(raw, 1)["static"] = map[string]interface{}{"root": "/"}
+		}, "only be changed by owners"},
+		{"editor changes static options", editor, func(raw map[string]interface{}) {
+			proxyAt(raw, 1)["static"] = map[string]interface{}{"root": "/srv/docs", "spa": true}
+		}, ""},
+		{"editor adds static route", editor, func(raw map[string]interface{}) {
+			proxyAt(raw, 0)["routes"] = []interface{}{map[string]interface{}{"path_prefix": "/files", "static": map[string]interface{}{"root": "/etc"}}}
+		}, "only be changed by owners"},
+		{"editor sets access log path", editor, func(raw map[string]interface{}) {
+			proxyAt(raw, 0)["access_log"] = map[string]interface{}{"path": "/etc/cron.d/pylon"}
+		}, "only be changed by owners"},
+		{"editor enables access log", editor, func(raw map[string]interface{}) {
+			proxyAt(raw, 0)["access_log"] = map[string]interface{}{"format": "json"}
+		}, ""},
+		{"delegated adds user to own proxy", delegated, addUser(0), ""},
+		{"delegated adds user to other proxy", delegated, addUser(1), "allowed users of docs.example.com"},
+		{"delegated changes upstream", delegated, func(raw map[string]interface{}) { proxyAt(raw, 0)["internal"] = "http://evil:80" }, "may not be changed"},
+		{"delegated adds proxy", delegated, addProxy(map[string]interface{}{"external": "new.example.com", "internal": "http://new:80"}), "added or removed"},
+		{"delegated changes global users", delegated, func(raw map[string]interface{}) { raw["allowed_users"] = []interface{}{"bob@example.com"} }, "global allowed users"},
+	}
+	for _, tt := range tests {
+		current := editConfig(t, nil)
+		submitted := editConfig(t, tt.edit)
+		err := authorizeConfigChange(tt.admin, current, &submitted)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: rejected: %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: allowed", tt.name)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error %q, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestAuthorizeConfigChangeRestoresSecrets(t *testing.T) {
+	editor := AdminEntry{Email: "editor@example.com", Role: adminRoleEditor}
+	current := editConfig(t, nil)
+	submitted := redactConfig(current)
+	if err := authorizeConfigChange(editor, current, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	if submitted.SessionKey != "secret" || submitted.AdminNotifyWebhook != current.AdminNotifyWebhook || submitted.OAuthProviders["google"].ClientSecret != "secret" {
+		t.Errorf("secrets not restored: %+v", submitted)
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	conf := redactConfig(editConfig(t, nil))
+	if conf.SessionKey != "" || conf.AdminNotifyWebhook != "" || conf.OAuthProviders["google"].ClientSecret != "" {
+		t.Errorf("secrets left in %+v", conf)
+	}
+}
+
+func TestAdminRequestOrigins(t *testing.T) {
+	cfgMu.Lock()
+	saved := cfg
+	cfg = Config{TLDN: "example.com", AdminURL: "https://admin.example.com/"}
+	cfgMu.Unlock()
+	defer func() {
+		cfgMu.Lock()
+		cfg = saved
+		cfgMu.Unlock()
+	}()
+
+	tests := []struct {
+		method string
+		origin string
+		passed bool
+		cors   bool
+	}{
+		{"POST", "", true, false},
+		{"POST", "https://admin.example.com", true, true},
+		{"POST", "http://admin.example.com", false, false},
+		{"POST", "https://wiki.example.com", false, false},
+		{"DELETE", "https://wiki.example.com", false, false},
+		{"POST", "null", false, false},
+		{"POST", "http://panel.internal:3001", true, false}, // the request's own host
+		{"GET", "https://wiki.example.com", true, false},
+		{"OPTIONS", "https://admin.example.com", true, true},
+	}
+	for _, tt := range tests {
+		passed := false
+		handler := adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			passed = true
+			enableAdminCORS(&w, r)
+		}))
+		r := httptest.NewRequest(tt.method, "http://panel.internal:3001/config", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if passed != tt.passed {
+			t.Errorf("%s from %q: passed = %v, want %v", tt.method, tt.origin, passed, tt.passed)
+		}
+		if cors := w.Header().Get("Access-Control-Allow-Origin") != ""; cors != tt.cors {
+			t.Errorf("%s from %q: CORS allowed = %v, want %v", tt.method, tt.origin, cors, tt.cors)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Append-only audit log of configuration changes, one JSON entry per line in
+// config_audit.log next to config.json.
+
+// configActor is who or what is saving the config.
+type configActor struct {
+	Name    string
+	Address string
+	Reason  string
+}
+
+// ConfigAuditEntry records one config save and what it changed.
+type ConfigAuditEntry struct {
+	Time    time.Time      `json:"time"`
+	Actor   string         `json:"actor"`
+	Address string         `json:"address,omitempty"`
+	Reason  string         `json:"reason,omitempty"`
+	Changes []ConfigChange `json:"changes"`
+}
+
+// ConfigChange is a single difference between two configs, e.g.
+// {"kind": "proxy_user", "action": "removed", "target": "wiki.example.com", "detail": "bob@example.com"}
+type ConfigChange struct {
+	Kind   string `json:"kind"`   // "proxy", "proxy_user", "user", "provider" or "setting"
+	Action string `json:"action"` // "added", "removed" or "changed"
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+	// JSON values of a changed field, left out for secrets
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Fields whose values never go into the audit log. Header rules and tracing
+// can carry credentials for upstreams and the collector.
+var configSecretFields = []string{"client_secret", "session_key", "admin_password_hash", "oauth", "admin_notify_webhook", "headers", "tracing"}
+
+var configAuditMu sync.Mutex
+
+// adminActor attributes a config change to the admin making the request.
+func adminActor(r *http.Request, reason string) configActor {
+	name := adminFromRequest(r).Email
+	if name == "" {
+		name = "onboarding"
+	}
+	return configActor{Name: name, Address: clientIP(r).String(), Reason: reason}
+}
+
+func appendConfigAudit(actor configActor, before, after Config) error {
+	changes := diffConfigs(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	line, err := json.Marshal(ConfigAuditEntry{
+		Time:    time.Now().UTC(),
+		Actor:   actor.Name,
+		Address: actor.Address,
+		Reason:  actor.Reason,
+		Changes: changes,
+	})
+	if err != nil {
+		return err
+	}
+
+	configAuditMu.Lock()
+	defer configAuditMu.Unlock()
+	f, err := os.OpenFile(getDataPath("config_audit.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// jsonFields flattens a struct into its JSON fields for comparison.
+func jsonFields(v interface{}) map[string]string {
+	fields := make(map[string]string)
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fields
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return fields
+	}
+	for key, value := range raw {
+		fields[key] = string(value)
+	}
+	return fields
+}
+
+// fieldChanges describes the JSON fields that differ between a and b, except
+// the ignored ones.
+func fieldChanges(kind string, target string, a, b interface{}, ignore ...string) []ConfigChange {
+	af, bf := jsonFields(a), jsonFields(b)
+	var names []string
+	for key := range af {
+		if af[key] != bf[key] && !sliceContains(ignore, key) {
+			names = append(names, key)
+		}
+	}
+	for key := range bf {
+		if _, found := af[key]; !found && !sliceContains(ignore, key) {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []ConfigChange
+	for _, name := range names {
+		change := ConfigChange{Kind: kind, Action: "changed", Target: target, Detail: name}
+		if kind == "setting" {
+			change.Target, change.Detail = name, ""
+		}
+		if !sliceContains(configSecretFields, name) {
+			change.Before, change.After = af[name], bf[name]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// grantDetail describes an allowed user entry, with its time window if any.
+func grantDetail(u AllowedUser) string {
+	if u.NotBefore == nil && u.Expires == nil {
+		return u.Email
+	}
+	b, _ := json.Marshal(u)
+	return string(b)
+}
+
+func diffConfigs(before, after Config) []ConfigChange {
+	var changes []ConfigChange
+
+	// Proxies, by external host
+	beforeProxies := make(map[string]int)
+	for i, p := range before.Proxies {
+		beforeProxies[p.External] = i
+	}
+	afterProxies := make(map[string]int)
+	for i, p := range after.Proxies {
+		afterProxies[p.External] = i
+	}
+	for _, p := range before.Proxies {
+		if _, found := afterProxies[p.External]; !found {
+			changes = append(changes, ConfigChange{Kind: "proxy", Action: "removed", Target: p.External})
+		}
+	}
+	for _, p := range after.Proxies {
+		i, found := beforeProxies[p.External]
+		if !found {
+			changes = append(changes, ConfigChange{Kind: "proxy", Action: "added", Target: p.External, Detail: p.Internal})
+			continue
+		}
+		old := before.Proxies[i]
+		changes = append(changes, fieldChanges("proxy", p.External, old, p, "allowed_users")...)
+
+		oldUsers := make(map[string]string)
+		for _, u := range old.AllowedUsers {
+			oldUsers[u.Email] = grantDetail(u)
+		}
+		newUsers := make(map[string]bool)
+		for _, u := range p.AllowedUsers {
+			newUsers[u.Email] = true
+			if prev, found := oldUsers[u.Email]; !found {
+				changes = append(changes, ConfigChange{Kind: "proxy_user", Action: "added", Target: p.External, Detail: grantDetail(u)})
+			} else if prev != grantDetail(u) {
+				changes = append(changes, ConfigChange{Kind: "proxy_user", Action: "changed", Target: p.External, Detail: u.Email, Before: prev, After: grantDetail(u)})
+			}
+		}
+		for _, u := range old.AllowedUsers {
+			if !newUsers[u.Email] {
+				changes = append(changes, ConfigChange{Kind: "proxy_user", Action: "removed", Target: p.External, Detail: u.Email})
+			}
+		}
+	}
+
+	// Global allowed users
+	for _, u := range after.AllowedUsers {
+		if !sliceContains(before.AllowedUsers, u) {
+			changes = append(changes, ConfigChange{Kind: "user", Action: "added", Target: u})
+		}
+	}
+	for _, u := range before.AllowedUsers {
+		if !sliceContains(after.AllowedUsers, u) {
+			changes = append(changes, ConfigChange{Kind: "user", Action: "removed", Target: u})
+		}
+	}
+
+	// OAuth providers; secrets are only named, never logged
+	var providerKeys []string
+	for key := range before.OAuthProviders {
+		providerKeys = append(providerKeys, key)
+	}
+	for key := range after.OAuthProviders {
+		if _, found := before.OAuthProviders[key]; !found {
+			providerKeys = append(providerKeys, key)
+		}
+	}
+	sort.Strings(providerKeys)
+	for _, key := range providerKeys {
+		old, wasThere := before.OAuthProviders[key]
+		p, isThere := after.OAuthProviders[key]
+		switch {
+		case !isThere:
+			changes = append(changes, ConfigChange{Kind: "provider", Action: "removed", Target: key})
+		case !wasThere:
+			changes = append(changes, ConfigChange{Kind: "provider", Action: "added", Target: key, Detail: p.Type})
+		default:
+			changes = append(changes, fieldChanges("provider", key, old, p)...)
+		}
+	}
+
+	// Everything else
+	changes = append(changes, fieldChanges("setting", "", before, after, "proxies", "allowed_users", "oauth_providers")...)
+
+	return changes
+}
+
+// AuditHandler pages through the config audit log, newest first, with
+// ?offset= and ?limit= (default 50). Delegated admins only see changes to
+// their own proxies.
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	enableAdminCORS(&w, r)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	admin := adminFromRequest(r)
+	total, page, err := readConfigAuditPage(admin, offset, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":   total,
+		"offset":  offset,
+		"entries": page,
+	})
+}
+
+// visibleAuditEntry keeps the changes to proxies the delegated admin sees,
+// reporting false for entries left without any.
+func visibleAuditEntry(entry ConfigAuditEntry, admin AdminEntry) (ConfigAuditEntry, bool) {
+	var changes []ConfigChange
+	for _, c := range entry.Changes {
+		if (c.Kind == "proxy" || c.Kind == "proxy_user") && admin.seesProxy(c.Target) {
+			changes = append(changes, c)
+		}
+	}
+	entry.Changes = changes
+	return entry, len(changes) > 0
+}
+
+// readConfigAuditPage reads the audit log from the end, returning how many
+// entries the admin sees in total and the page of them starting offset
+// entries from the newest. Only the page is held in memory.
+func readConfigAuditPage(admin AdminEntry, offset, limit int) (int, []ConfigAuditEntry, error) {
+	configAuditMu.Lock()
+	defer configAuditMu.Unlock()
+
+	total := 0
+	page := []ConfigAuditEntry{}
+	err := readLogLinesReverse(getDataPath("config_audit.log"), func(line []byte) bool {
+		inPage := total >= offset && len(page) < limit
+		if !inPage && admin.Role != adminRoleDelegated {
+			// Only counted, so there's no need to decode it
+			if json.Valid(line) {
+				total++
+			}
+			return true
+		}
+		var entry ConfigAuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return true
+		}
+		if admin.Role == adminRoleDelegated {
+			var visible bool
+			if entry, visible = visibleAuditEntry(entry, admin); !visible {
+				return true
+			}
+		}
+		if inPage {
+			page = append(page, entry)
+		}
+		total++
+		return true
+	})
+	return total, page, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestReadConfigAuditPage(t *testing.T) {
+	chdirTemp(t)
+
+	// Entries 0 to 9, the odd ones changing wiki and the even ones docs
+	for i := 0; i < 10; i++ {
+		proxy := "docs.example.com"
+		if i%2 == 1 {
+			proxy = "wiki.example.com"
+		}
+		var after Config
+		json.Unmarshal([]byte(fmt.Sprintf(`{"proxies": [{"external": %q, "internal": "http://app:%d"}]}`, proxy, i)), &after)
+		if err := appendConfigAudit(configActor{Name: fmt.Sprint(i)}, Config{}, after); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, _ := os.OpenFile(getDataPath("config_audit.log"), os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString("not json\n")
+	f.Close()
+
+	owner := AdminEntry{Role: adminRoleOwner}
+	delegated := AdminEntry{Role: adminRoleDelegated, Proxies: []string{"wiki.example.com"}}
+	tests := []struct {
+		admin  AdminEntry
+		offset int
+		limit  int
+		total  int
+		actors string
+	}{
+		{owner, 0, 3, 10, "987"},
+		{owner, 8, 3, 10, "10"},
+		{owner, 10, 3, 10, ""},
+		{delegated, 0, 2, 5, "97"},
+		{delegated, 3, 5, 5, "31"},
+	}
+	for _, tt := range tests {
+		total, page, err := readConfigAuditPage(tt.admin, tt.offset, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actors := ""
+		for _, entry := range page {
+			actors += entry.Actor
+			if tt.admin.Role == adminRoleDelegated && entry.Changes[0].Target != "wiki.example.com" {
+				t.Errorf("delegated admin shown %+v", entry.Changes)
+			}
+		}
+		if total != tt.total || actors != tt.actors {
+			t.Errorf("%s at %d+%d: got %d total, %q, want %d, %q", tt.admin.Role, tt.offset, tt.limit, total, actors, tt.total, tt.actors)
+		}
+	}
+}
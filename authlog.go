@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Structured log of authentication and authorization decisions, one JSON
+// event per line in auth.log next to config.json (see auth_log).
+
+// Auth event types
+const (
+	authEventLogin         = "login"
+	authEventLoginFailure  = "login_failure"
+	authEventCallbackError = "callback_error"
+	authEventAllow         = "allow"
+	authEventDeny          = "deny"
+	authEventBypass        = "bypass"
+)
+
+// AuthEvent is one authentication or authorization decision.
+type AuthEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	User     string    `json:"user,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Proxy    string    `json:"proxy,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	TokenID  string    `json:"token_id,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Opened by loadConfig, guarded by cfgMu
+var authLog *rotatingFile
+
+// emitAuthEvent records ev for request r, filling in the time, client
+// address, host and path when not set.
+func emitAuthEvent(r *http.Request, ev AuthEvent) {
+	ev.Time = time.Now().UTC()
+	switch ev.Event {
+	case authEventLogin:
+		loginsTotal.inc(ev.Provider, "success")
+	case authEventLoginFailure:
+		loginsTotal.inc(ev.Provider, "failure")
+	}
+	if ev.Address == "" {
+		ev.Address = clientIP(r).String()
+	}
+	if ev.Proxy == "" {
+		ev.Proxy = r.Host
+		if pd := requestInfoFrom(r).Proxy; pd != nil {
+			ev.Proxy = pd.External
+		}
+	}
+	if ev.Path == "" {
+		ev.Path = r.URL.Path
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	cfgMu.RLock()
+	w := authLog
+	cfgMu.RUnlock()
+	if w == nil {
+		return
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write auth log: %v", err)
+	}
+}
+
+// refererHost is the proxy host a login will return to.
+func refererHost(referer string) string {
+	if i := strings.IndexByte(referer, '/'); i >= 0 {
+		return referer[:i]
+	}
+	return referer
+}
+
+// AuthEventsHandler queries the auth log, newest first. Filters are
+// ?user=, ?proxy=, ?event=, and ?since= / ?until= as RFC 3339 times;
+// ?limit= defaults to 100. Delegated admins only see their own proxies.
+func AuthEventsHandler(w http.ResponseWriter, r *http.Request) {
+	enableAdminCORS(&w, r)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	var since, until time.Time
+	var err error
+	if s := q.Get("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid since time", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid until time", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	admin := adminFromRequest(r)
+
+	match := func(ev AuthEvent) bool {
+		if u := q.Get("user"); u != "" && !strings.EqualFold(ev.User, u) {
+			return false
+		}
+		if p := q.Get("proxy"); p != "" && ev.Proxy != p {
+			return false
+		}
+		if e := q.Get("event"); e != "" && ev.Event != e {
+			return false
+		}
+		if !since.IsZero() && ev.Time.Before(since) {
+			return false
+		}
+		if !until.IsZero() && ev.Time.After(until) {
+			return false
+		}
+		return admin.seesProxy(ev.Proxy)
+	}
+
+	cfgMu.RLock()
+	rf := authLog
+	cfgMu.RUnlock()
+
+	events := []AuthEvent{}
+	if rf != nil {
+		for _, path := range rf.files() {
+			err := readLogLinesReverse(path, func(line []byte) bool {
+				var ev AuthEvent
+				if err := json.Unmarshal(line, &ev); err == nil && match(ev) {
+					events = append(events, ev)
+				}
+				return len(events) < limit
+			})
+			if err != nil {
+				http.Error(w, "Failed to read auth log", http.StatusInternalServerError)
+				return
+			}
+			// Older files only hold older events
+			if len(events) >= limit {
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// readLogLinesReverse calls fn with the lines of a log file, last first,
+// until fn returns false. The file is read backwards a chunk at a time, so
+// only as much of it is read as is needed. A missing file has no lines. The
+// line passed to fn is only valid during the call.
+func readLogLinesReverse(path string, fn func(line []byte) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	const chunkSize = 64 * 1024
+	const maxLineSize = 16 * 1024 * 1024
+	offset := info.Size()
+	var partial []byte // the start of the file read so far, before its first newline
+	for offset > 0 {
+		n := int64(chunkSize)
+		if n > offset {
+			n = offset
+		}
+		offset -= n
+		buf := make([]byte, n, n+int64(len(partial)))
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return err
+		}
+		buf = append(buf, partial...)
+		for {
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			if line := buf[i+1:]; len(line) > 0 && !fn(line) {
+				return nil
+			}
+			buf = buf[:i]
+		}
+		if len(buf) > maxLineSize {
+			return bufio.ErrTooLong
+		}
+		partial = buf
+	}
+	if len(partial) > 0 {
+		fn(partial)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Admin login brute-force protection. Failed basic auth attempts are counted
+// per client address; from adminMaxFailures on, each further failure bans the
+// address for twice as long as the previous one.
+const (
+	adminMaxFailures   = 5
+	adminBaseBan       = time.Minute
+	adminMaxBan        = 24 * time.Hour
+	adminFailureWindow = 24 * time.Hour // failures are forgotten after this long
+)
+
+type adminLoginFailures struct {
+	Address     string    `json:"address"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	BannedUntil time.Time `json:"banned_until"`
+}
+
+var (
+	adminFailuresMu    sync.Mutex
+	adminFailures      = make(map[string]*adminLoginFailures)
+	adminFailuresSwept time.Time
+)
+
+// sweepAdminFailures forgets addresses whose failures are older than the
+// window, so addresses that fail once don't accumulate. adminFailuresMu must
+// be held.
+func sweepAdminFailures(now time.Time) {
+	if now.Sub(adminFailuresSwept) < time.Minute {
+		return
+	}
+	adminFailuresSwept = now
+	for addr, f := range adminFailures {
+		if now.Sub(f.LastFailure) > adminFailureWindow {
+			delete(adminFailures, addr)
+		}
+	}
+}
+
+// adminBanRemaining returns how long the address is still banned for.
+func adminBanRemaining(addr string) time.Duration {
+	adminFailuresMu.Lock()
+	defer adminFailuresMu.Unlock()
+	f, found := adminFailures[addr]
+	if !found {
+		return 0
+	}
+	return time.Until(f.BannedUntil)
+}
+
+// recordAdminFailure counts a failed login, returning the ban it triggered.
+func recordAdminFailure(addr string) time.Duration {
+	adminFailuresMu.Lock()
+	defer adminFailuresMu.Unlock()
+
+	now := time.Now()
+	sweepAdminFailures(now)
+	f, found := adminFailures[addr]
+	if !found || now.Sub(f.LastFailure) > adminFailureWindow {
+		f = &adminLoginFailures{Address: addr}
+		adminFailures[addr] = f
+	}
+	f.Failures++
+	f.LastFailure = now
+
+	if f.Failures < adminMaxFailures {
+		return 0
+	}
+	ban := adminBaseBan << uint(f.Failures-adminMaxFailures)
+	if ban > adminMaxBan || ban <= 0 {
+		ban = adminMaxBan
+	}
+	f.BannedUntil = now.Add(ban)
+	return ban
+}
+
+func recordAdminSuccess(addr string) {
+	adminFailuresMu.Lock()
+	defer adminFailuresMu.Unlock()
+	delete(adminFailures, addr)
+}
+
+// BansHandler lists the addresses currently banned from the admin panel and
+// lets admins lift a ban with DELETE /bans?address=...
+func BansHandler(w http.ResponseWriter, r *http.Request) {
+	enableAdminCORS(&w, r)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method == "GET" {
+		// Bans aren't about any one proxy
+		if admin := adminFromRequest(r); admin.Role == adminRoleDelegated {
+			writeAdminForbidden(w, admin)
+			return
+		}
+		adminFailuresMu.Lock()
+		bans := []adminLoginFailures{}
+		for _, f := range adminFailures {
+			if time.Now().Before(f.BannedUntil) {
+				bans = append(bans, *f)
+			}
+		}
+		adminFailuresMu.Unlock()
+
+		sort.Slice(bans, func(i, j int) bool { return bans[i].BannedUntil.After(bans[j].BannedUntil) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bans)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if admin := adminFromRequest(r); admin.Role != adminRoleOwner {
+			writeAdminForbidden(w, admin)
+			return
+		}
+		addr := r.URL.Query().Get("address")
+		recordAdminSuccess(addr)
+		log.Printf("Admin login ban for %s lifted", addr)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("okay"))
+		return
+	}
+
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
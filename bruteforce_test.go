@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func resetAdminFailures() {
+	adminFailuresMu.Lock()
+	adminFailures = make(map[string]*adminLoginFailures)
+	adminFailuresSwept = time.Time{}
+	adminFailuresMu.Unlock()
+}
+
+func TestAdminBanDurations(t *testing.T) {
+	defer resetAdminFailures()
+
+	tests := []struct {
+		failures int
+		ban      time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{7, 4 * time.Minute},
+		{15, 1024 * time.Minute},
+		{16, adminMaxBan},
+		{100, adminMaxBan}, // past the shift overflowing
+	}
+	for _, tt := range tests {
+		resetAdminFailures()
+		var ban time.Duration
+		for i := 0; i < tt.failures; i++ {
+			ban = recordAdminFailure("192.0.2.1")
+		}
+		if ban != tt.ban {
+			t.Errorf("%d failures: ban %v, want %v", tt.failures, ban, tt.ban)
+		}
+		remaining := adminBanRemaining("192.0.2.1")
+		if remaining > tt.ban || (tt.ban > 0 && remaining < tt.ban-time.Second) {
+			t.Errorf("%d failures: %v of the ban remaining", tt.failures, remaining)
+		}
+		if adminBanRemaining("192.0.2.2") > 0 {
+			t.Errorf("%d failures: other address banned", tt.failures)
+		}
+	}
+}
+
+func TestAdminBanExpiry(t *testing.T) {
+	defer resetAdminFailures()
+	resetAdminFailures()
+
+	for i := 0; i < adminMaxFailures; i++ {
+		recordAdminFailure("192.0.2.1")
+	}
+	adminFailuresMu.Lock()
+	adminFailures["192.0.2.1"].BannedUntil = time.Now().Add(-time.Second)
+	adminFailuresMu.Unlock()
+	if adminBanRemaining("192.0.2.1") > 0 {
+		t.Error("ban outlasted its expiry")
+	}
+	// Failures are still counted until the window passes
+	if ban := recordAdminFailure("192.0.2.1"); ban != 2*adminBaseBan {
+		t.Errorf("failure after an expired ban banned for %v", ban)
+	}
+
+	adminFailuresMu.Lock()
+	adminFailures["192.0.2.1"].LastFailure = time.Now().Add(-adminFailureWindow - time.Minute)
+	adminFailuresMu.Unlock()
+	if ban := recordAdminFailure("192.0.2.1"); ban != 0 {
+		t.Errorf("failure after the window banned for %v", ban)
+	}
+
+	recordAdminSuccess("192.0.2.1")
+	adminFailuresMu.Lock()
+	defer adminFailuresMu.Unlock()
+	if _, found := adminFailures["192.0.2.1"]; found {
+		t.Error("failures kept after a successful login")
+	}
+}
+
+func TestBansHandler(t *testing.T) {
+	defer resetAdminFailures()
+	resetAdminFailures()
+	for i := 0; i < adminMaxFailures+1; i++ {
+		recordAdminFailure("192.0.2.1")
+	}
+	for i := 0; i < adminMaxFailures; i++ {
+		recordAdminFailure("192.0.2.2")
+	}
+	recordAdminFailure("192.0.2.3")
+
+	owner := AdminEntry{Email: "owner@example.com", Role: adminRoleOwner}
+	editor := AdminEntry{Email: "editor@example.com", Role: adminRoleEditor}
+	delegated := AdminEntry{Email: "lead@example.com", Role: adminRoleDelegated, Proxies: []string{"wiki.example.com"}}
+
+	tests := []struct {
+		admin  AdminEntry
+		method string
+		target string
+		status int
+		bans   []string
+	}{
+		{owner, "GET", "/bans", http.StatusOK, []string{"192.0.2.1", "192.0.2.2"}},
+		{editor, "GET", "/bans", http.StatusOK, []string{"192.0.2.1", "192.0.2.2"}},
+		{delegated, "GET", "/bans", http.StatusForbidden, nil},
+		{editor, "DELETE", "/bans?address=192.0.2.1", http.StatusForbidden, nil},
+		{owner, "DELETE", "/bans?address=192.0.2.1", http.StatusOK, nil},
+		{owner, "GET", "/bans", http.StatusOK, []string{"192.0.2.2"}},
+		{owner, "POST", "/bans", http.StatusMethodNotAllowed, nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		BansHandler(w, withAdmin(httptest.NewRequest(tt.method, tt.target, nil), tt.admin))
+		if w.Code != tt.status {
+			t.Errorf("%s %s %s: status %d, want %d", tt.admin.Role, tt.method, tt.target, w.Code, tt.status)
+			continue
+		}
+		if tt.bans == nil {
+			continue
+		}
+		var bans []adminLoginFailures
+		json.Unmarshal(w.Body.Bytes(), &bans)
+		var addrs []string
+		for _, b := range bans {
+			addrs = append(addrs, b.Address)
+		}
+		if len(addrs) != len(tt.bans) || (len(addrs) > 0 && addrs[0] != tt.bans[0]) {
+			t.Errorf("%s %s %s: bans %q, want %q", tt.admin.Role, tt.method, tt.target, addrs, tt.bans)
+		}
+	}
+}
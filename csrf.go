@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// The pylon session cookie is SameSite=Lax on the whole TLDN, so any proxied
+// app on a sibling host can post forms with it. Pylon's own forms therefore
+// carry a token only its pages know, and posts from other origins are
+// refused outright.
+
+// csrfToken is the anti-CSRF token of a logged in session: a MAC of its
+// login, so it needs no storage and changes with every login.
+func csrfToken(id authIdentity) string {
+	cfgMu.RLock()
+	key := cfg.SessionKey
+	cfgMu.RUnlock()
+	mac := hmac.New(sha256.New, []byte("pylon csrf\n"+key))
+	fmt.Fprintf(mac, "%s\n%s\n%d", id.Email, id.Provider, id.AuthTime.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// csrfField is the hidden form input carrying the session's token.
+func csrfField(id authIdentity) string {
+	return fmt.Sprintf(`<input type="hidden" name="csrf_token" value="%s">`, html.EscapeString(csrfToken(id)))
+}
+
+// sameOrigin reports whether a request was sent from a page on its own host
+// or on one of the other origins given. Requests without an Origin header
+// weren't sent by a browser's form or fetch, which always add one to posts.
+func sameOrigin(r *http.Request, others ...string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, other := range others {
+		if origin == other {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// checkCSRF verifies a state changing request was posted from one of
+// Pylon's pages on this host, answering 403 when it wasn't.
+func checkCSRF(w http.ResponseWriter, r *http.Request, id authIdentity) bool {
+	if !sameOrigin(r) {
+		log.Printf("Refused %s %s from %s for %s: foreign origin %q", r.Method, r.URL.Path, clientIP(r), id.Email, r.Header.Get("Origin"))
+		writePylonPage(w, http.StatusForbidden, "Request refused", "This form was sent from another site.", "")
+		return false
+	}
+	token := r.PostFormValue("csrf_token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken(id))) != 1 {
+		log.Printf("Refused %s %s from %s for %s: missing or invalid CSRF token", r.Method, r.URL.Path, clientIP(r), id.Email)
+		writePylonPage(w, http.StatusForbidden, "Request refused", "This form has expired. Go back, reload the page and try again.", "")
+		return false
+	}
+	return true
+}
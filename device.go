@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth 2.0 Device Authorization Grant (RFC 8628). A CLI requests a device
+// code, the user approves its user code at /pylon/device after logging in
+// through the normal gateway, and the CLI polls for a Pylon bearer token
+// scoped to the requested proxy hosts.
+
+const (
+	deviceGrantType     = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeLifetime  = 10 * time.Minute
+	devicePollInterval  = 5 * time.Second
+	deviceUserCodeChars = "BCDFGHJKLMNPQRSTVWXZ" // no vowels, so no accidental words
+)
+
+type deviceAuthorization struct {
+	DeviceCodeHash string
+	UserCode       string
+	ClientID       string
+	Scopes         []string
+	ExpiresAt      time.Time
+	Interval       time.Duration
+	LastPoll       time.Time
+	Status         string // "pending", "approved" or "denied"
+	Email          string
+	Provider       string
+}
+
+var (
+	deviceAuthsMu sync.Mutex
+	deviceAuths   = make(map[string]*deviceAuthorization) // keyed by normalized user code
+
+	// Failed user code lookups per user and per client address, so codes
+	// can't be guessed: 10, then one more per minute
+	deviceLookupFailures = newRateLimiter(&RateLimit{RequestsPerSecond: 1.0 / 60, Burst: 10})
+)
+
+func generateUserCode() string {
+	// Bytes past the last whole multiple of the alphabet size would favour
+	// its first characters, so they are drawn again
+	limit := 256 - 256%len(deviceUserCodeChars)
+	code := make([]byte, 0, 8)
+	b := make([]byte, 16)
+	for len(code) < 8 {
+		if _, err := rand.Read(b); err != nil {
+			return ""
+		}
+		for _, c := range b {
+			if int(c) < limit && len(code) < 8 {
+				code = append(code, deviceUserCodeChars[int(c)%len(deviceUserCodeChars)])
+			}
+		}
+	}
+	return string(code)
+}
+
+// normalizeUserCode accepts user codes typed with any case or separators.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+func formatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func writeOAuthJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeOAuthError(w http.ResponseWriter, code string) {
+	writeOAuthJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+// deviceCodeHandler issues device and user codes (RFC 8628 section 3.2). The
+// scope parameter is a space separated list of proxy hosts and defaults to
+// the host the request was made to.
+func deviceCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, "invalid_request")
+		return
+	}
+
+	requested := strings.Fields(r.PostForm.Get("scope"))
+	if len(requested) == 0 {
+		requested = []string{r.Host}
+	}
+	// Tokens are scoped to proxies by their external, whichever of their
+	// hosts was asked for
+	var scopes []string
+	for _, scope := range requested {
+		pd, found := scopeProxy(scope)
+		if !found {
+			writeOAuthError(w, "invalid_scope")
+			return
+		}
+		if !sliceContains(scopes, pd.External) {
+			scopes = append(scopes, pd.External)
+		}
+	}
+
+	deviceCode := generateState() + generateState()
+	userCode := generateUserCode()
+	if len(deviceCode) < 64 || userCode == "" {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	deviceAuthsMu.Lock()
+	for code, da := range deviceAuths {
+		if time.Now().After(da.ExpiresAt) {
+			delete(deviceAuths, code)
+		}
+	}
+	deviceAuths[userCode] = &deviceAuthorization{
+		DeviceCodeHash: hashToken(deviceCode),
+		UserCode:       userCode,
+		ClientID:       r.PostForm.Get("client_id"),
+		Scopes:         scopes,
+		ExpiresAt:      time.Now().Add(deviceCodeLifetime),
+		Interval:       devicePollInterval,
+		Status:         "pending",
+	}
+	deviceAuthsMu.Unlock()
+
+	verificationURI := fmt.Sprintf("https://%s/pylon/device", r.Host)
+	writeOAuthJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 formatUserCode(userCode),
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + formatUserCode(userCode),
+		"expires_in":                int(deviceCodeLifetime.Seconds()),
+		"interval":                  int(devicePollInterval.Seconds()),
+	})
+}
+
+// deviceVerifyHandler is the browser page where a logged in user approves or
+// denies a pending device authorization.
+func deviceVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	userCode := normalizeUserCode(r.FormValue("user_code"))
+
+	sessionStore := getSessionStore()
+	session, _ := sessionStore.Get(r, "pylon")
+	if session.Values["email"] == nil {
+		referer := r.Host + "/pylon/device"
+		if userCode != "" {
+			referer += "?user_code=" + formatUserCode(userCode)
+		}
+		http.Redirect(w, r, "/pylon/login?referer="+url.QueryEscape(referer), http.StatusFound)
+		return
+	}
+	id := sessionIdentity(w, r, session)
+
+	if userCode == "" {
+		writePylonPage(w, http.StatusOK, "Pylon Device Login", "Enter the code shown in your terminal.", `
+			<form method="GET" action="/pylon/device">
+				<input class="pylon-input" name="user_code" placeholder="XXXX-XXXX" autocomplete="off" autofocus>
+				<button class="login-btn" type="submit" style="background-color: #4f46e5;">Continue</button>
+			</form>
+		`)
+		return
+	}
+
+	failureKeys := []string{"user:" + id.Email, "ip:" + clientIP(r).String()}
+	for _, key := range failureKeys {
+		if blocked, retryAfter := deviceLookupFailures.exhausted(key); blocked {
+			log.Printf("Too many invalid device codes from %s (%s)", id.Email, clientIP(r))
+			writeRateLimited(w, retryAfter)
+			return
+		}
+	}
+
+	deviceAuthsMu.Lock()
+	da, found := deviceAuths[userCode]
+	if found && (time.Now().After(da.ExpiresAt) || da.Status != "pending") {
+		found = false
+	}
+	deviceAuthsMu.Unlock()
+
+	if !found {
+		for _, key := range failureKeys {
+			deviceLookupFailures.allow(key)
+		}
+		writePylonPage(w, http.StatusNotFound, "Pylon Device Login", "This code is invalid or has expired. Start the login from your terminal again.", "")
+		return
+	}
+
+	if r.Method != "POST" {
+		var scopesHTML strings.Builder
+		for _, scope := range da.Scopes {
+			scopesHTML.WriteString("<li>" + html.EscapeString(scope) + "</li>")
+		}
+		client := da.ClientID
+		if client == "" {
+			client = "A command line client"
+		}
+		writePylonPage(w, http.StatusOK, "Pylon Device Login", fmt.Sprintf("%s is requesting access as %s to:", client, id.Email), fmt.Sprintf(`
+			<ul class="pylon-list">%s</ul>
+			<form method="POST" action="/pylon/device">
+				<input type="hidden" name="user_code" value="%s">
+				%s
+				<button class="login-btn" type="submit" name="action" value="approve" style="background-color: #16a34a;">Approve</button>
+				<button class="login-btn" type="submit" name="action" value="deny" style="background-color: #dc2626;">Deny</button>
+			</form>
+		`, scopesHTML.String(), html.EscapeString(formatUserCode(userCode)), csrfField(id)))
+		return
+	}
+
+	if !checkCSRF(w, r, id) {
+		return
+	}
+
+	if r.FormValue("action") != "approve" {
+		deviceAuthsMu.Lock()
+		da.Status = "denied"
+		deviceAuthsMu.Unlock()
+		writePylonPage(w, http.StatusOK, "Pylon Device Login", "Access denied. You can close this window.", "")
+		return
+	}
+
+	// The token can only be scoped to proxies the user may access themselves.
+	// Tokens carry no GitHub memberships, so only direct grants count.
+	for _, scope := range da.Scopes {
+		pd, found := lookupProxyByName(scope)
+		if !found || !pd.authorizes(authIdentity{Email: id.Email}) || !pd.acceptsProvider(id.Provider) {
+			log.Printf("user %s cannot approve device access to %s", id.Email, scope)
+			writePylonPage(w, http.StatusForbidden, "Pylon Device Login", fmt.Sprintf("You are not authorized to access %s.", scope), "")
+			return
+		}
+	}
+
+	deviceAuthsMu.Lock()
+	da.Status = "approved"
+	da.Email = id.Email
+	da.Provider = id.Provider
+	deviceAuthsMu.Unlock()
+
+	log.Printf("user %s approved device access to %s", id.Email, strings.Join(da.Scopes, ", "))
+	writePylonPage(w, http.StatusOK, "Pylon Device Login", "Device approved. You can return to your terminal.", "")
+}
+
+// deviceTokenHandler is polled by the CLI until the user has approved or
+// denied the request (RFC 8628 section 3.4).
+func deviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, "invalid_request")
+		return
+	}
+	if r.PostForm.Get("grant_type") != deviceGrantType {
+		writeOAuthError(w, "unsupported_grant_type")
+		return
+	}
+
+	deviceCodeHash := hashToken(r.PostForm.Get("device_code"))
+
+	deviceAuthsMu.Lock()
+	var da *deviceAuthorization
+	for _, candidate := range deviceAuths {
+		if candidate.DeviceCodeHash == deviceCodeHash {
+			da = candidate
+			break
+		}
+	}
+	if da == nil {
+		deviceAuthsMu.Unlock()
+		writeOAuthError(w, "invalid_grant")
+		return
+	}
+	if time.Now().After(da.ExpiresAt) {
+		delete(deviceAuths, da.UserCode)
+		deviceAuthsMu.Unlock()
+		writeOAuthError(w, "expired_token")
+		return
+	}
+	if time.Since(da.LastPoll) < da.Interval {
+		da.Interval += devicePollInterval
+		da.LastPoll = time.Now()
+		deviceAuthsMu.Unlock()
+		writeOAuthError(w, "slow_down")
+		return
+	}
+	da.LastPoll = time.Now()
+
+	switch da.Status {
+	case "pending":
+		deviceAuthsMu.Unlock()
+		writeOAuthError(w, "authorization_pending")
+		return
+	case "denied":
+		delete(deviceAuths, da.UserCode)
+		deviceAuthsMu.Unlock()
+		writeOAuthError(w, "access_denied")
+		return
+	}
+	// Approved codes can only be redeemed once
+	delete(deviceAuths, da.UserCode)
+	deviceAuthsMu.Unlock()
+
+	cfgMu.RLock()
+	ttl := time.Duration(cfg.DeviceTokenTTL)
+	cfgMu.RUnlock()
+	if ttl <= 0 {
+		ttl = 30 * 24 * time.Hour
+	}
+
+	name := da.ClientID
+	if name == "" {
+		name = "device"
+	}
+	plain, _, err := issueToken(APIToken{
+		Kind:     "device",
+		Name:     name,
+		Email:    da.Email,
+		Provider: da.Provider,
+		Scopes:   da.Scopes,
+	}, ttl)
+	if err != nil {
+		log.Printf("Failed to issue device token for %s: %v", da.Email, err)
+		writeOAuthJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeOAuthJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": plain,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"scope":        strings.Join(da.Scopes, " "),
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func pollDeviceToken(deviceCode string) (int, map[string]interface{}) {
+	form := url.Values{"grant_type": {deviceGrantType}, "device_code": {deviceCode}}
+	r := httptest.NewRequest("POST", "/pylon/device/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	deviceTokenHandler(w, r)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func TestDeviceTokenPolling(t *testing.T) {
+	chdirTemp(t)
+	defer func() {
+		deviceAuthsMu.Lock()
+		deviceAuths = make(map[string]*deviceAuthorization)
+		deviceAuthsMu.Unlock()
+		tokensMu.Lock()
+		apiTokens = nil
+		tokensMu.Unlock()
+	}()
+
+	add := func(userCode, deviceCode, status string, expiresIn time.Duration) *deviceAuthorization {
+		da := &deviceAuthorization{
+			DeviceCodeHash: hashToken(deviceCode),
+			UserCode:       userCode,
+			Scopes:         []string{"wiki.example.com"},
+			ExpiresAt:      time.Now().Add(expiresIn),
+			Interval:       devicePollInterval,
+			Status:         status,
+			Email:          "alice@example.com",
+		}
+		deviceAuthsMu.Lock()
+		deviceAuths[userCode] = da
+		deviceAuthsMu.Unlock()
+		return da
+	}
+	removed := func(userCode string) bool {
+		deviceAuthsMu.Lock()
+		defer deviceAuthsMu.Unlock()
+		_, found := deviceAuths[userCode]
+		return !found
+	}
+
+	if _, body := pollDeviceToken("unknown"); body["error"] != "invalid_grant" {
+		t.Errorf("unknown code: %v", body)
+	}
+
+	pending := add("PENDINGA", "pending-code", "pending", deviceCodeLifetime)
+	if _, body := pollDeviceToken("pending-code"); body["error"] != "authorization_pending" {
+		t.Errorf("pending code: %v", body)
+	}
+	if _, body := pollDeviceToken("pending-code"); body["error"] != "slow_down" {
+		t.Errorf("polling too fast: %v", body)
+	}
+	if pending.Interval != 2*devicePollInterval {
+		t.Errorf("interval after slow_down is %v", pending.Interval)
+	}
+	pending.LastPoll = time.Now().Add(-pending.Interval)
+	if _, body := pollDeviceToken("pending-code"); body["error"] != "authorization_pending" {
+		t.Errorf("polling at the slower interval: %v", body)
+	}
+
+	add("EXPIREDA", "expired-code", "pending", -time.Second)
+	if _, body := pollDeviceToken("expired-code"); body["error"] != "expired_token" || !removed("EXPIREDA") {
+		t.Errorf("expired code: %v", body)
+	}
+
+	add("DENIEDAA", "denied-code", "denied", deviceCodeLifetime)
+	if _, body := pollDeviceToken("denied-code"); body["error"] != "access_denied" || !removed("DENIEDAA") {
+		t.Errorf("denied code: %v", body)
+	}
+
+	add("APPROVED", "approved-code", "approved", deviceCodeLifetime)
+	status, body := pollDeviceToken("approved-code")
+	plain, _ := body["access_token"].(string)
+	if status != http.StatusOK || !strings.HasPrefix(plain, apiTokenPrefix) || body["scope"] != "wiki.example.com" {
+		t.Fatalf("approved code: %d %v", status, body)
+	}
+	if token, ok := lookupToken(plain); !ok || token.Email != "alice@example.com" || token.Kind != "device" {
+		t.Errorf("issued token %+v, %v", token, ok)
+	}
+	if _, body := pollDeviceToken("approved-code"); body["error"] != "invalid_grant" {
+		t.Errorf("approved code redeemed twice: %v", body)
+	}
+}
+
+func TestDeviceLookupFailuresThrottle(t *testing.T) {
+	cfgMu.Lock()
+	savedStore := store
+	store = sessions.NewCookieStore([]byte("test session key"))
+	cfgMu.Unlock()
+	savedFailures := deviceLookupFailures
+	deviceLookupFailures = newRateLimiter(&RateLimit{RequestsPerSecond: 1.0 / 60, Burst: 10})
+	defer func() {
+		cfgMu.Lock()
+		store = savedStore
+		cfgMu.Unlock()
+		deviceLookupFailures = savedFailures
+	}()
+
+	sessionCookie := func(email string) *http.Cookie {
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		session, _ := getSessionStore().Get(r, "pylon")
+		session.Values["email"] = email
+		if err := session.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		return w.Result().Cookies()[0]
+	}
+	verify := func(email, addr string) int {
+		r := httptest.NewRequest("GET", "/pylon/device?user_code=WRONG-CODE", nil)
+		r.RemoteAddr = addr
+		r.AddCookie(sessionCookie(email))
+		w := httptest.NewRecorder()
+		deviceVerifyHandler(w, r)
+		return w.Code
+	}
+
+	for i := 1; i <= 10; i++ {
+		if code := verify("mallory@example.com", "192.0.2.1:1234"); code != http.StatusNotFound {
+			t.Fatalf("guess %d: status %d", i, code)
+		}
+	}
+	tests := []struct {
+		email string
+		addr  string
+		want  int
+	}{
+		{"mallory@example.com", "192.0.2.1:1234", http.StatusTooManyRequests},
+		{"mallory@example.com", "198.51.100.1:1234", http.StatusTooManyRequests}, // same user elsewhere
+		{"eve@example.com", "192.0.2.1:1234", http.StatusTooManyRequests},        // same address
+		{"alice@example.com", "198.51.100.2:1234", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := verify(tt.email, tt.addr); code != tt.want {
+			t.Errorf("%s from %s: status %d, want %d", tt.email, tt.addr, code, tt.want)
+		}
+	}
+}
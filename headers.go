@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// HeaderRules changes the headers of a proxy's requests before they are
+// forwarded and of its responses before they reach the client.
+type HeaderRules struct {
+	Request  HeaderOps `json:"request,omitempty"`
+	Response HeaderOps `json:"response,omitempty"`
+	// Adds securityHeaders to responses, before Response is applied so it
+	// can override them
+	SecurityPreset bool `json:"security_preset,omitempty"`
+}
+
+// HeaderOps are applied in order: Remove, then Set, then Add.
+type HeaderOps struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// securityHeaders is the security_preset: HSTS, no MIME sniffing, no framing
+// by other sites, and no Server or X-Powered-By details.
+var securityHeaders = HeaderOps{
+	Set: map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+	},
+	Remove: []string{"Server", "X-Powered-By"},
+}
+
+func (ops *HeaderOps) apply(h http.Header) {
+	for _, name := range ops.Remove {
+		h.Del(name)
+	}
+	for name, value := range ops.Set {
+		h.Set(name, value)
+	}
+	for name, value := range ops.Add {
+		h.Add(name, value)
+	}
+}
+
+func (ops *HeaderOps) empty() bool {
+	return len(ops.Set) == 0 && len(ops.Add) == 0 && len(ops.Remove) == 0
+}
+
+// applyRequest changes the headers of a request about to be forwarded.
+// Setting Host changes the host the upstream sees.
+func (rules *HeaderRules) applyRequest(r *http.Request) {
+	if rules == nil {
+		return
+	}
+	rules.Request.apply(r.Header)
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+		r.Header.Del("Host")
+	}
+}
+
+// wrap returns w with the response rules applied when the headers are
+// written, covering proxied responses as well as Pylon's own pages.
+func (rules *HeaderRules) wrap(w http.ResponseWriter) http.ResponseWriter {
+	if rules == nil || (!rules.SecurityPreset && rules.Response.empty()) {
+		return w
+	}
+	return &headerRulesWriter{ResponseWriter: w, rules: rules}
+}
+
+type headerRulesWriter struct {
+	http.ResponseWriter
+	rules   *HeaderRules
+	applied bool
+}
+
+func (hw *headerRulesWriter) applyRules() {
+	if hw.applied {
+		return
+	}
+	hw.applied = true
+	if hw.rules.SecurityPreset {
+		securityHeaders.apply(hw.Header())
+	}
+	hw.rules.Response.apply(hw.Header())
+}
+
+func (hw *headerRulesWriter) WriteHeader(status int) {
+	// Informational responses such as 103 Early Hints come before the
+	// final headers
+	if status >= 200 {
+		hw.applyRules()
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerRulesWriter) Write(b []byte) (int, error) {
+	hw.applyRules()
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *headerRulesWriter) Flush() {
+	hw.applyRules()
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (hw *headerRulesWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := hw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
+
+func (hw *headerRulesWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderOpsApply(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  HeaderOps
+		in   http.Header
+		want http.Header
+	}{
+		{
+			name: "set replaces every value",
+			ops:  HeaderOps{Set: map[string]string{"x-env": "prod"}},
+			in:   http.Header{"X-Env": {"dev", "test"}},
+			want: http.Header{"X-Env": {"prod"}},
+		},
+		{
+			name: "add keeps existing values",
+			ops:  HeaderOps{Add: map[string]string{"Vary": "Origin"}},
+			in:   http.Header{"Vary": {"Accept-Encoding"}},
+			want: http.Header{"Vary": {"Accept-Encoding", "Origin"}},
+		},
+		{
+			name: "remove",
+			ops:  HeaderOps{Remove: []string{"server", "X-Missing"}},
+			in:   http.Header{"Server": {"nginx"}, "Date": {"today"}},
+			want: http.Header{"Date": {"today"}},
+		},
+		{
+			name: "remove before set before add",
+			ops: HeaderOps{
+				Remove: []string{"X-A", "X-B"},
+				Set:    map[string]string{"X-A": "set"},
+				Add:    map[string]string{"X-A": "added", "X-B": "added"},
+			},
+			in:   http.Header{"X-A": {"old"}, "X-B": {"old"}},
+			want: http.Header{"X-A": {"set", "added"}, "X-B": {"added"}},
+		},
+	}
+	for _, tt := range tests {
+		tt.ops.apply(tt.in)
+		if !reflect.DeepEqual(tt.in, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.in, tt.want)
+		}
+	}
+}
+
+func TestHeaderRulesApplyRequest(t *testing.T) {
+	rules := &HeaderRules{Request: HeaderOps{
+		Set:    map[string]string{"Host": "internal.example.com", "X-Team": "platform"},
+		Remove: []string{"Cookie"},
+	}}
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.Header.Set("Cookie", "pylon=secret")
+	rules.applyRequest(r)
+	if r.Host != "internal.example.com" || r.Header.Get("Host") != "" {
+		t.Errorf("host %q, header %q", r.Host, r.Header.Get("Host"))
+	}
+	if r.Header.Get("X-Team") != "platform" || r.Header.Get("Cookie") != "" {
+		t.Errorf("headers %v", r.Header)
+	}
+
+	var none *HeaderRules
+	none.applyRequest(r)
+	if r.Host != "internal.example.com" {
+		t.Error("nil rules changed the request")
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that can also be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (hr *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hr.hijacked = true
+	return nil, nil, nil
+}
+
+func TestHeaderRulesWriter(t *testing.T) {
+	rules := &HeaderRules{
+		SecurityPreset: true,
+		Response: HeaderOps{
+			Set:    map[string]string{"X-Frame-Options": "DENY"},
+			Add:    map[string]string{"Cache-Control": "no-store"},
+			Remove: []string{"X-Debug"},
+		},
+	}
+	upstream := func(w http.ResponseWriter) {
+		w.Header().Set("Server", "nginx")
+		w.Header().Set("X-Debug", "1")
+		w.Header().Set("Cache-Control", "private")
+	}
+	check := func(name string, h http.Header) {
+		want := map[string][]string{
+			"X-Frame-Options":           {"DENY"},
+			"X-Content-Type-Options":    {"nosniff"},
+			"Strict-Transport-Security": {"max-age=31536000; includeSubDomains"},
+			"Cache-Control":             {"private", "no-store"},
+			"Server":                    nil,
+			"X-Debug":                   nil,
+		}
+		for name, values := range want {
+			if got := h.Values(name); !reflect.DeepEqual(got, values) && !(len(got) == 0 && values == nil) {
+				t.Errorf("%s: %s is %q, want %q", name, name, got, values)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+	}{
+		{"WriteHeader", func(w http.ResponseWriter) { w.WriteHeader(http.StatusOK) }},
+		{"Write", func(w http.ResponseWriter) { w.Write([]byte("hello")) }},
+		{"Flush", func(w http.ResponseWriter) { w.(http.Flusher).Flush() }},
+		{"repeated writes", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("b"))
+		}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		w := rules.wrap(rec)
+		upstream(w)
+		tt.write(w)
+		check(tt.name, rec.Result().Header)
+	}
+
+	// Informational responses go out before the rules are applied
+	rec := httptest.NewRecorder()
+	w := rules.wrap(rec)
+	upstream(w)
+	w.Header().Set("Link", "</app.css>; rel=preload")
+	w.WriteHeader(http.StatusEarlyHints)
+	if w.Header().Get("Server") != "nginx" || w.Header().Get("X-Frame-Options") != "" {
+		t.Errorf("rules applied to an informational response: %v", w.Header())
+	}
+	w.WriteHeader(http.StatusOK)
+	if w.Header().Get("Server") != "" || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("rules not applied after an informational response: %v", w.Header())
+	}
+
+	// The wrapper stays hijackable for WebSocket upgrades
+	hr := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w = rules.wrap(hr)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		t.Fatal("wrapper is not a Hijacker")
+	}
+	if _, _, err := hijacker.Hijack(); err != nil || !hr.hijacked {
+		t.Errorf("hijack not passed through: %v", err)
+	}
+	if _, _, err := rules.wrap(httptest.NewRecorder()).(http.Hijacker).Hijack(); err == nil {
+		t.Error("hijacked a writer that can't be")
+	}
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok || u.Unwrap() != hr {
+		t.Error("wrapper doesn't unwrap")
+	}
+
+	// Without response rules the writer isn't wrapped at all
+	rec = httptest.NewRecorder()
+	if (&HeaderRules{Request: HeaderOps{Set: map[string]string{"X-A": "1"}}}).wrap(rec) != rec {
+		t.Error("wrapped without response rules")
+	}
+	var none *HeaderRules
+	if none.wrap(rec) != rec {
+		t.Error("wrapped without rules")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures active health checks of each of a proxy's targets.
+type HealthCheck struct {
+	Path string `json:"path"` // defaults to "/"
+	// Status that counts as healthy; any 2xx or 3xx when not set
+	ExpectedStatus int      `json:"expected_status,omitempty"`
+	Interval       Duration `json:"interval,omitempty"` // defaults to 30s
+	Timeout        Duration `json:"timeout,omitempty"`  // defaults to 5s
+}
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+)
+
+// Upstream health states
+const (
+	healthUnknown = "unknown"
+	healthUp      = "up"
+	healthDown    = "down"
+)
+
+// UpstreamHealth is the latest health check result of an upstream.
+type UpstreamHealth struct {
+	Status    string    `json:"status"`
+	Target    string    `json:"target"`
+	LastError string    `json:"last_error,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	// When the status last changed
+	Since time.Time `json:"since"`
+}
+
+type healthKey struct {
+	external string
+	target   string
+}
+
+var (
+	healthMu       sync.Mutex
+	upstreamHealth = make(map[healthKey]*UpstreamHealth)
+	// Closed to stop the running checkers on config reload
+	healthStop chan struct{}
+)
+
+// startHealthChecks (re)starts the checkers for every proxy with a health
+// check. Results are kept across reloads unless the target changed.
+func startHealthChecks(conf Config) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	if healthStop != nil {
+		close(healthStop)
+	}
+	healthStop = make(chan struct{})
+
+	checked := make(map[healthKey]bool)
+	for _, p := range conf.Proxies {
+		if p.HealthCheck == nil {
+			continue
+		}
+		targets := upstreamTargets(p.Internal, p.Targets)
+		for _, route := range p.Routes {
+			targets = upstreamTargets("", append(targets, upstreamTargets(route.Internal, route.Targets)...))
+		}
+		for _, target := range targets {
+			// Hosts of wildcard proxies aren't known ahead of time
+			if isHostTemplate(target) {
+				continue
+			}
+			key := healthKey{p.External, target}
+			checked[key] = true
+			if _, found := upstreamHealth[key]; !found {
+				upstreamHealth[key] = &UpstreamHealth{Status: healthUnknown, Target: target, Since: time.Now()}
+			}
+			go runHealthChecks(key, *p.HealthCheck, conf.InsecureSkipVerify, healthStop)
+		}
+	}
+	for key := range upstreamHealth {
+		if !checked[key] {
+			delete(upstreamHealth, key)
+		}
+	}
+}
+
+// Checkers share a transport per TLS verification setting, so those
+// restarted by a reload reuse the keep-alive connections of the ones they
+// replace. Connections to targets no longer checked are closed once idle.
+var healthTransports = map[bool]*http.Transport{
+	false: newHealthTransport(false),
+	true:  newHealthTransport(true),
+}
+
+func newHealthTransport(insecureSkipVerify bool) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		IdleConnTimeout: 90 * time.Second,
+	}
+}
+
+func runHealthChecks(key healthKey, check HealthCheck, insecureSkipVerify bool, stop chan struct{}) {
+	interval := time.Duration(check.Interval)
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := time.Duration(check.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: healthTransports[insecureSkipVerify],
+		// The upstream answering at all is what counts, not where it redirects to
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	url := strings.TrimSuffix(key.target, "/") + "/" + strings.TrimPrefix(check.Path, "/")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := probeUpstream(client, url, check.ExpectedStatus)
+		recordHealth(key, err, time.Since(start), stop)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probeUpstream(client *http.Client, url string, expectedStatus int) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Pylon-HealthCheck")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if expectedStatus != 0 {
+		if resp.StatusCode != expectedStatus {
+			return fmt.Errorf("status %d, expected %d", resp.StatusCode, expectedStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func recordHealth(key healthKey, err error, latency time.Duration, stop chan struct{}) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	// Results of checkers stopped by a reload are stale
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	h, found := upstreamHealth[key]
+	if !found {
+		return
+	}
+
+	status := healthUp
+	h.LastError = ""
+	if err != nil {
+		status = healthDown
+		h.LastError = err.Error()
+	}
+	if status != h.Status {
+		if status == healthDown {
+			log.Printf("upstream %s for %s is down: %v", key.target, key.external, err)
+		} else if h.Status == healthDown {
+			log.Printf("upstream %s for %s is back up", key.target, key.external)
+		}
+		h.Status = status
+		h.Since = time.Now()
+	}
+	h.LatencyMS = float64(latency.Microseconds()) / 1000
+	h.LastCheck = time.Now()
+}
+
+// targetsHealth returns the health of each checked target of the proxy
+// serving external.
+func targetsHealth(external string) []UpstreamHealth {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	var list []UpstreamHealth
+	for key, h := range upstreamHealth {
+		if key.external == external {
+			list = append(list, *h)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	return list
+}
+
+// healthOf sums up the health of the proxy serving external: up while any
+// target is up, down once all are. The second result is false for proxies
+// without health checks.
+func healthOf(external string) (UpstreamHealth, bool) {
+	list := targetsHealth(external)
+	if len(list) == 0 {
+		return UpstreamHealth{}, false
+	}
+	if len(list) == 1 {
+		return list[0], true
+	}
+	summary := UpstreamHealth{Status: healthDown}
+	for _, h := range list {
+		switch {
+		case h.Status == healthUp:
+			summary.Status = healthUp
+		case h.Status == healthUnknown && summary.Status == healthDown:
+			summary.Status = healthUnknown
+		}
+		if h.LastError != "" && summary.LastError == "" {
+			summary.LastError = h.LastError
+		}
+		if h.Since.After(summary.Since) {
+			summary.Since = h.Since
+		}
+	}
+	return summary, true
+}
+
+// isTargetDown reports whether the last health check of one target failed.
+func isTargetDown(external string, target string) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h, found := upstreamHealth[healthKey{external, target}]
+	return found && h.Status == healthDown
+}
+
+// writeServiceDownPage tells the user the service behind the proxy isn't
+// answering, instead of a bare 502.
+func writeServiceDownPage(w http.ResponseWriter, r *http.Request, status int) {
+	w.Header().Set("Retry-After", "30")
+	writePylonPage(w, status, "Service unavailable",
+		fmt.Sprintf("%s is not responding right now. Please try again in a moment.", r.Host), "")
+}
+
+// UpstreamHealthHandler lists the health of all checked targets, by external
+// host. Delegated admins only see their own proxies.
+func UpstreamHealthHandler(w http.ResponseWriter, r *http.Request) {
+	enableAdminCORS(&w, r)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin := adminFromRequest(r)
+	health := make(map[string][]UpstreamHealth)
+	healthMu.Lock()
+	for key, h := range upstreamHealth {
+		if admin.Role != adminRoleDelegated || sliceContains(admin.Proxies, key.external) {
+			health[key.external] = append(health[key.external], *h)
+		}
+	}
+	healthMu.Unlock()
+	for _, list := range health {
+		sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Wildcard proxies: an external like "*.preview.example.com" serves every
+// host matching it, and "{1}", "{2}", ... in its upstreams are replaced with
+// the labels the wildcards matched, e.g. "http://{1}.preview.internal:8080".
+// Exact externals take precedence over wildcards.
+
+// hostTemplatePattern matches the placeholders in upstream URLs.
+var hostTemplatePattern = regexp.MustCompile(`\{([0-9]+)\}`)
+
+// isWildcardHost reports whether external is a host pattern.
+func isWildcardHost(external string) bool {
+	return strings.Contains(external, "*")
+}
+
+// compileHostPattern turns a wildcard external into a regexp capturing one
+// DNS label per "*".
+func compileHostPattern(external string) (*regexp.Regexp, error) {
+	labels := strings.Split(strings.ToLower(external), ".")
+	for i, label := range labels {
+		switch {
+		case label == "*":
+			labels[i] = `([a-z0-9-]+)`
+		case strings.Contains(label, "*"):
+			return nil, fmt.Errorf("invalid wildcard host %q: * must be a whole label", external)
+		default:
+			labels[i] = regexp.QuoteMeta(label)
+		}
+	}
+	return regexp.Compile(`^` + strings.Join(labels, `\.`) + `$`)
+}
+
+// checkHostTemplates makes sure the upstreams of a proxy only refer to
+// wildcards its external has, and are valid URLs once filled in.
+func checkHostTemplates(external string, targets []string) error {
+	wildcards := strings.Count(external, "*")
+	for _, target := range targets {
+		for _, m := range hostTemplatePattern.FindAllStringSubmatch(target, -1) {
+			n, _ := strconv.Atoi(m[1])
+			if n < 1 || n > wildcards {
+				return fmt.Errorf("%q for %s refers to %s, but the host has %d wildcards", target, external, m[0], wildcards)
+			}
+		}
+		if _, err := url.Parse(sampleHostTemplate(external, target)); err != nil {
+			return fmt.Errorf("invalid internal URL %q: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// sampleHostTemplate fills the placeholders of target as some host matching
+// external would, to validate the result.
+func sampleHostTemplate(external string, target string) string {
+	sample := make([]string, strings.Count(external, "*"))
+	for i := range sample {
+		sample[i] = "0"
+	}
+	return expandHostTemplate(target, sample)
+}
+
+func isHostTemplate(target string) bool {
+	return hostTemplatePattern.MatchString(target)
+}
+
+// expandHostTemplate fills the placeholders of target with captures.
+func expandHostTemplate(target string, captures []string) string {
+	return hostTemplatePattern.ReplaceAllStringFunc(target, func(m string) string {
+		n, _ := strconv.Atoi(m[1 : len(m)-1])
+		if n < 1 || n > len(captures) {
+			return m
+		}
+		return captures[n-1]
+	})
+}
+
+// wildcardProxy is a proxy registered under a wildcard external or alias.
+type wildcardProxy struct {
+	pattern *regexp.Regexp
+	details *ProxyDetails
+}
+
+// lookupWildcardProxy finds the first wildcard proxy, in config order,
+// matching host. Callers hold proxiesMu.
+func lookupWildcardProxy(host string) (*ProxyDetails, bool) {
+	host = strings.ToLower(stripPort(host))
+	for _, wp := range wildcardProxies {
+		if wp.pattern.MatchString(host) {
+			return wp.details, true
+		}
+	}
+	return nil, false
+}
+
+// hostCaptures returns the labels the wildcards of the proxy serving host
+// matched, or nil when an exact external serves it.
+func hostCaptures(host string) []string {
+	proxiesMu.RLock()
+	defer proxiesMu.RUnlock()
+	if _, found := proxies[host]; found {
+		return nil
+	}
+	host = strings.ToLower(stripPort(host))
+	for _, wp := range wildcardProxies {
+		if m := wp.pattern.FindStringSubmatch(host); m != nil {
+			return m[1:]
+		}
+	}
+	return nil
+}
+
+// Certificates are requested when a host is first visited, and anyone can
+// make up hosts under a wildcard, so those are capped to stay clear of the
+// CA's rate limits: 20, then one more an hour.
+var wildcardCertRequests = newRateLimiter(&RateLimit{RequestsPerSecond: 1.0 / 3600, Burst: 20})
+
+// certHostPolicy is the autocert host policy: certificates are only
+// requested for configured hosts. It is only asked about hosts without a
+// cached certificate.
+func certHostPolicy(ctx context.Context, host string) error {
+	if !isAllowedDomain(host) {
+		return fmt.Errorf("acme/autocert: host %q not configured", host)
+	}
+	if hostCaptures(host) == nil {
+		return nil
+	}
+	if ok, _ := wildcardCertRequests.allow("wildcard"); !ok {
+		log.Printf("Not requesting a certificate for %s: too many new wildcard hosts", host)
+		return fmt.Errorf("acme/autocert: too many certificates requested for wildcard hosts")
+	}
+	return nil
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
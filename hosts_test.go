@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCompileHostPattern(t *testing.T) {
+	tests := []struct {
+		external string
+		host     string
+		captures []string // nil when host doesn't match
+	}{
+		{"*.preview.example.com", "feature-x.preview.example.com", []string{"feature-x"}},
+		{"*.preview.example.com", "FEATURE-X.preview.example.com", nil},
+		{"*.preview.example.com", "preview.example.com", nil},
+		{"*.preview.example.com", "a.b.preview.example.com", nil},
+		{"*.preview.example.com", "feature-x.previewxexample.com", nil},
+		{"*.preview.example.com", "feature_x.preview.example.com", nil},
+		{"*.*.example.com", "app.eu.example.com", []string{"app", "eu"}},
+		{"api.*.example.com", "api.eu.example.com", []string{"eu"}},
+		{"api.*.example.com", "web.eu.example.com", nil},
+		{"*.Example.COM", "app.example.com", []string{"app"}},
+	}
+	for _, tt := range tests {
+		pattern, err := compileHostPattern(tt.external)
+		if err != nil {
+			t.Errorf("%s: %v", tt.external, err)
+			continue
+		}
+		m := pattern.FindStringSubmatch(tt.host)
+		var captures []string
+		if m != nil {
+			captures = m[1:]
+		}
+		if !reflect.DeepEqual(captures, tt.captures) {
+			t.Errorf("%s matching %s: got %q, want %q", tt.external, tt.host, captures, tt.captures)
+		}
+	}
+
+	for _, invalid := range []string{"app*.example.com", "*app.example.com", "a.**.example.com"} {
+		if _, err := compileHostPattern(invalid); err == nil {
+			t.Errorf("%s: accepted", invalid)
+		}
+	}
+}
+
+func TestExpandHostTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		captures []string
+		want     string
+	}{
+		{"http://{1}.preview.internal:8080", []string{"feature-x"}, "http://feature-x.preview.internal:8080"},
+		{"http://{2}-{1}.internal", []string{"app", "eu"}, "http://eu-app.internal"},
+		{"http://{1}.internal/{1}", []string{"app"}, "http://app.internal/app"},
+		{"http://static.internal", []string{"app"}, "http://static.internal"},
+		{"http://{2}.internal", []string{"app"}, "http://{2}.internal"},
+		{"http://{0}.internal", []string{"app"}, "http://{0}.internal"},
+	}
+	for _, tt := range tests {
+		if got := expandHostTemplate(tt.template, tt.captures); got != tt.want {
+			t.Errorf("%s with %q: got %s, want %s", tt.template, tt.captures, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHostTemplates(t *testing.T) {
+	tests := []struct {
+		external string
+		targets  []string
+		ok       bool
+	}{
+		{"*.preview.example.com", []string{"http://{1}.preview.internal"}, true},
+		{"*.*.example.com", []string{"http://{1}.{2}.internal"}, true},
+		{"*.preview.example.com", []string{"http://{2}.preview.internal"}, false},
+		{"app.example.com", []string{"http://{1}.internal"}, false},
+		{"app.example.com", []string{"http://app.internal"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkHostTemplates(tt.external, tt.targets); (err == nil) != tt.ok {
+			t.Errorf("%s %q: error %v", tt.external, tt.targets, err)
+		}
+	}
+}
+
+func TestExpandedPoolsEvictLeastRecentlyUsed(t *testing.T) {
+	pool, err := newUpstreamPool("*.preview.example.com", []string{"http://{1}.preview.internal"}, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := pool.forHost([]string{"first"})
+	for i := 1; i < maxExpandedPools; i++ {
+		pool.forHost([]string{fmt.Sprintf("host%d", i)})
+	}
+	// Using first again makes host1 the least recently used
+	if again, _ := pool.forHost([]string{"first"}); again != first {
+		t.Fatal("cached pool not reused")
+	}
+	pool.forHost([]string{"one-more"})
+
+	if len(pool.expanded) != maxExpandedPools {
+		t.Fatalf("%d pools cached, want %d", len(pool.expanded), maxExpandedPools)
+	}
+	if _, found := pool.expanded["first"]; !found {
+		t.Error("recently used pool evicted")
+	}
+	if _, found := pool.expanded["host1"]; found {
+		t.Error("least recently used pool kept")
+	}
+	if got := first.targets[0].URL; got != "http://first.preview.internal" {
+		t.Errorf("expanded target %s", got)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPRules restricts access by client address. Entries are CIDRs
+// ("192.168.0.0/16", "fd00::/8") or single addresses.
+type IPRules struct {
+	// Clients in these networks are always rejected
+	Deny []string `json:"deny,omitempty"`
+	// If set, only clients in these networks are let through
+	Allow []string `json:"allow,omitempty"`
+	// Clients in these networks skip OAuth entirely
+	TrustedNetworks []string `json:"trusted_networks,omitempty"`
+}
+
+type ipRuleSet struct {
+	deny    []*net.IPNet
+	allow   []*net.IPNet
+	trusted []*net.IPNet
+}
+
+func compileIPRules(rules IPRules) (ipRuleSet, error) {
+	var set ipRuleSet
+	var err error
+	if set.deny, err = parseNetworks(rules.Deny); err != nil {
+		return set, err
+	}
+	if set.allow, err = parseNetworks(rules.Allow); err != nil {
+		return set, err
+	}
+	if set.trusted, err = parseNetworks(rules.TrustedNetworks); err != nil {
+		return set, err
+	}
+	return set, nil
+}
+
+// parseNetworks parses CIDRs, treating bare addresses as single host networks.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func networksContain(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether the rules let the client through at all.
+func (set ipRuleSet) permits(ip net.IP) bool {
+	if networksContain(set.deny, ip) {
+		return false
+	}
+	if len(set.allow) > 0 && !networksContain(set.allow, ip) {
+		return false
+	}
+	return true
+}
+
+func (set ipRuleSet) trusts(ip net.IP) bool {
+	return networksContain(set.trusted, ip)
+}
+
+// clientIP returns the address of the client. Forwarding headers are only
+// believed when the connection comes from one of the configured trusted
+// proxies, in which case the rightmost untrusted X-Forwarded-For hop wins.
+// Proxies may append their hop as a header line of its own rather than to
+// the client's, so all lines are read as one list.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	cfgMu.RLock()
+	trusted := trustedProxies
+	cfgMu.RUnlock()
+
+	if !networksContain(trusted, ip) {
+		return ip
+	}
+
+	if xff := strings.Join(r.Header.Values("X-Forwarded-For"), ","); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !networksContain(trusted, hop) {
+				break
+			}
+		}
+		return ip
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP
+	}
+	return ip
+}
+
+// globalIPRulesPermit applies the global deny and allow lists.
+func globalIPRulesPermit(ip net.IP) bool {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return globalIPRules.permits(ip)
+}
+
+func globalIPRulesTrust(ip net.IP) bool {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return globalIPRules.trusts(ip)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseNetworks([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgMu.Lock()
+	saved := trustedProxies
+	trustedProxies = trusted
+	cfgMu.Unlock()
+	defer func() {
+		cfgMu.Lock()
+		trustedProxies = saved
+		cfgMu.Unlock()
+	}()
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"direct", "203.0.113.7:4321", nil, "", "203.0.113.7"},
+		{"untrusted peer's headers ignored", "203.0.113.7:4321", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7"},
+		{"trusted peer", "10.0.0.1:4321", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"trusted IPv6 peer", "[fd00::1]:4321", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"forged first hop", "10.0.0.1:4321", []string{"192.0.2.66, 198.51.100.1"}, "", "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.1:4321", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "", "198.51.100.1"},
+		{"hop on its own line", "10.0.0.1:4321", []string{"192.0.2.66", "198.51.100.1"}, "", "198.51.100.1"},
+		{"trusted hop on its own line", "10.0.0.1:4321", []string{"198.51.100.1", "10.0.0.2"}, "", "198.51.100.1"},
+		{"garbage hop", "10.0.0.1:4321", []string{"192.0.2.66, garbage, 10.0.0.2"}, "", "10.0.0.2"},
+		{"only trusted hops", "10.0.0.1:4321", []string{"10.0.0.2"}, "", "10.0.0.2"},
+		{"X-Real-IP fallback", "10.0.0.1:4321", nil, "198.51.100.1", "198.51.100.1"},
+		{"garbage X-Real-IP", "10.0.0.1:4321", nil, "garbage", "10.0.0.1"},
+		{"X-Forwarded-For before X-Real-IP", "10.0.0.1:4321", []string{"198.51.100.1"}, "192.0.2.66", "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, line := range tt.xff {
+			r.Header.Add("X-Forwarded-For", line)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := clientIP(r); got.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancing configures how requests are spread over a proxy's targets.
+type LoadBalancing struct {
+	// "round_robin" (default), "least_connections", "random", "ip_hash" or
+	// "cookie" for sticky sessions
+	Strategy   string `json:"strategy,omitempty"`
+	CookieName string `json:"cookie_name,omitempty"` // defaults to "pylon_upstream"
+	// A target failing MaxFails times within FailTimeout is left out for
+	// FailTimeout. Defaults to 3 and 30s.
+	MaxFails    int      `json:"max_fails,omitempty"`
+	FailTimeout Duration `json:"fail_timeout,omitempty"`
+}
+
+const (
+	lbRoundRobin       = "round_robin"
+	lbLeastConnections = "least_connections"
+	lbRandom           = "random"
+	lbIPHash           = "ip_hash"
+	lbCookie           = "cookie"
+
+	defaultLBCookieName  = "pylon_upstream"
+	defaultLBMaxFails    = 3
+	defaultLBFailTimeout = 30 * time.Second
+
+	// Pools expanded for the hosts of a wildcard proxy that are kept, least
+	// recently used first out
+	maxExpandedPools = 1000
+)
+
+// upstreamTarget is one upstream of a proxy with its passive failure state.
+type upstreamTarget struct {
+	URL   string
+	ID    string // stable, for sticky session cookies
+	proxy *httputil.ReverseProxy
+
+	active int64 // in flight requests
+
+	mu           sync.Mutex
+	fails        int
+	firstFail    time.Time
+	ejectedUntil time.Time
+}
+
+type upstreamPool struct {
+	external    string
+	strategy    string
+	cookieName  string
+	maxFails    int
+	failTimeout time.Duration
+	targets     []*upstreamTarget
+	next        uint32
+	transport   *http.Transport
+
+	// Set when the targets are host templates, filled in per host
+	templates          []string
+	lb                 *LoadBalancing
+	insecureSkipVerify bool
+	expandMu           sync.Mutex
+	expanded           map[string]*list.Element // of *expandedPool in expandedLRU
+	expandedLRU        *list.List               // most recently used first
+}
+
+type expandedPool struct {
+	key  string
+	pool *upstreamPool
+}
+
+// upstreamTargets lists a proxy's targets: Internal followed by Targets.
+func upstreamTargets(internal string, targets []string) []string {
+	var list []string
+	if internal != "" {
+		list = append(list, internal)
+	}
+	for _, t := range targets {
+		if t != "" && !sliceContains(list, t) {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// newUpstreamPool builds the pool for a proxy, keeping the failure state of
+// targets that were already in old.
+func newUpstreamPool(external string, targets []string, lb *LoadBalancing, insecureSkipVerify bool, old *upstreamPool) (*upstreamPool, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no internal URL or targets for %s", external)
+	}
+	pool := &upstreamPool{
+		external:    external,
+		strategy:    lbRoundRobin,
+		cookieName:  defaultLBCookieName,
+		maxFails:    defaultLBMaxFails,
+		failTimeout: defaultLBFailTimeout,
+	}
+	if lb != nil {
+		switch lb.Strategy {
+		case "":
+		case lbRoundRobin, lbLeastConnections, lbRandom, lbIPHash, lbCookie:
+			pool.strategy = lb.Strategy
+		default:
+			return nil, fmt.Errorf("unknown load balancing strategy %q for %s", lb.Strategy, external)
+		}
+		if lb.CookieName != "" {
+			pool.cookieName = lb.CookieName
+		}
+		if lb.MaxFails > 0 {
+			pool.maxFails = lb.MaxFails
+		}
+		if lb.FailTimeout > 0 {
+			pool.failTimeout = time.Duration(lb.FailTimeout)
+		}
+	}
+
+	for _, raw := range targets {
+		if isHostTemplate(raw) {
+			pool.templates = targets
+			pool.lb = lb
+			pool.insecureSkipVerify = insecureSkipVerify
+			return pool, nil
+		}
+	}
+
+	pool.transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: insecureSkipVerify,
+		},
+		IdleConnTimeout: 90 * time.Second,
+	}
+	for _, raw := range targets {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid internal URL %q: %v", raw, err)
+		}
+		sum := sha256.Sum256([]byte(raw))
+		t := &upstreamTarget{URL: raw, ID: hex.EncodeToString(sum[:8])}
+		if old != nil {
+			for _, prev := range old.targets {
+				if prev.URL == raw {
+					prev.mu.Lock()
+					t.fails, t.firstFail, t.ejectedUntil = prev.fails, prev.firstFail, prev.ejectedUntil
+					prev.mu.Unlock()
+				}
+			}
+		}
+		t.proxy = httputil.NewSingleHostReverseProxy(u)
+		t.proxy.Transport = pool.transport
+		t.proxy.ModifyResponse = pool.modifyResponse(t)
+		t.proxy.ErrorHandler = pool.errorHandler(t)
+		pool.targets = append(pool.targets, t)
+	}
+	return pool, nil
+}
+
+// forHost returns the pool serving a host of a wildcard proxy, with its
+// templates filled in with the host's captures. Other pools serve every host.
+func (p *upstreamPool) forHost(captures []string) (*upstreamPool, error) {
+	if p.templates == nil {
+		return p, nil
+	}
+	key := strings.Join(captures, ".")
+
+	p.expandMu.Lock()
+	defer p.expandMu.Unlock()
+	if e, found := p.expanded[key]; found {
+		p.expandedLRU.MoveToFront(e)
+		return e.Value.(*expandedPool).pool, nil
+	}
+	if p.expanded == nil {
+		p.expanded = make(map[string]*list.Element)
+		p.expandedLRU = list.New()
+	}
+	for len(p.expanded) >= maxExpandedPools {
+		oldest := p.expandedLRU.Remove(p.expandedLRU.Back()).(*expandedPool)
+		delete(p.expanded, oldest.key)
+		oldest.pool.transport.CloseIdleConnections()
+	}
+	targets := make([]string, len(p.templates))
+	for i, template := range p.templates {
+		targets[i] = expandHostTemplate(template, captures)
+	}
+	pool, err := newUpstreamPool(p.external, targets, p.lb, p.insecureSkipVerify, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.expanded[key] = p.expandedLRU.PushFront(&expandedPool{key: key, pool: pool})
+	return pool, nil
+}
+
+func (p *upstreamPool) modifyResponse(t *upstreamTarget) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		spanFromContext(resp.Request.Context()).setAttr("http.response.status_code", resp.StatusCode)
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			p.recordFailure(t, fmt.Errorf("status %d", resp.StatusCode))
+		default:
+			p.recordSuccess(t)
+		}
+		return nil
+	}
+}
+
+func (p *upstreamPool) errorHandler(t *upstreamTarget) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		spanFromContext(r.Context()).setError(err)
+		upstreamErrors.inc(p.external)
+		log.Printf("upstream error for %s (%s): %v", p.external, t.URL, err)
+		p.recordFailure(t, err)
+		writeServiceDownPage(w, r, http.StatusBadGateway)
+	}
+}
+
+func (p *upstreamPool) recordFailure(t *upstreamTarget, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.fails == 0 || now.Sub(t.firstFail) > p.failTimeout {
+		t.fails, t.firstFail = 0, now
+	}
+	t.fails++
+	if t.fails >= p.maxFails && len(p.targets) > 1 && now.After(t.ejectedUntil) {
+		t.ejectedUntil = now.Add(p.failTimeout)
+		log.Printf("ejecting upstream %s for %s for %v after %d failures: %v", t.URL, p.external, p.failTimeout, t.fails, err)
+	}
+}
+
+func (p *upstreamPool) recordSuccess(t *upstreamTarget) {
+	t.mu.Lock()
+	t.fails = 0
+	t.mu.Unlock()
+}
+
+// available reports whether the target is neither ejected nor failing its
+// health checks.
+func (p *upstreamPool) available(t *upstreamTarget) bool {
+	t.mu.Lock()
+	ejected := time.Now().Before(t.ejectedUntil)
+	t.mu.Unlock()
+	return !ejected && !isTargetDown(p.external, t.URL)
+}
+
+// down reports whether health checks found every target down.
+func (p *upstreamPool) down() bool {
+	for _, t := range p.targets {
+		if !isTargetDown(p.external, t.URL) {
+			return false
+		}
+	}
+	return true
+}
+
+// pick chooses the target for a request. When every target is unavailable
+// it still returns one, so the request fails visibly rather than silently.
+func (p *upstreamPool) pick(r *http.Request) *upstreamTarget {
+	var candidates []*upstreamTarget
+	for _, t := range p.targets {
+		if p.available(t) {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.targets
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch p.strategy {
+	case lbLeastConnections:
+		best := candidates[0]
+		for _, t := range candidates[1:] {
+			if atomic.LoadInt64(&t.active) < atomic.LoadInt64(&best.active) {
+				best = t
+			}
+		}
+		return best
+	case lbRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case lbIPHash:
+		// Hash over all targets so clients only move when theirs is unavailable
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(r).String()))
+		start := int(h.Sum32() % uint32(len(p.targets)))
+		for i := 0; i < len(p.targets); i++ {
+			t := p.targets[(start+i)%len(p.targets)]
+			if sliceContainsTarget(candidates, t) {
+				return t
+			}
+		}
+	case lbCookie:
+		if c, err := r.Cookie(p.cookieName); err == nil {
+			for _, t := range candidates {
+				if t.ID == c.Value {
+					return t
+				}
+			}
+		}
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return candidates[int(n-1)%len(candidates)]
+}
+
+func sliceContainsTarget(s []*upstreamTarget, t *upstreamTarget) bool {
+	for _, item := range s {
+		if item == t {
+			return true
+		}
+	}
+	return false
+}
+
+// serve proxies the request to target t, pinning cookie-sticky clients to it.
+func (p *upstreamPool) serve(w http.ResponseWriter, r *http.Request, t *upstreamTarget) {
+	if p.strategy == lbCookie {
+		if c, err := r.Cookie(p.cookieName); err != nil || c.Value != t.ID {
+			http.SetCookie(w, &http.Cookie{
+				Name:     p.cookieName,
+				Value:    t.ID,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+	atomic.AddInt64(&t.active, 1)
+	defer atomic.AddInt64(&t.active, -1)
+	t.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testPool(t *testing.T, lb *LoadBalancing) *upstreamPool {
+	pool, err := newUpstreamPool("app.example.com", []string{"http://a.internal", "http://b.internal", "http://c.internal"}, lb, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// picks returns the first letter of the target host picked for each of n
+// requests from addr.
+func picks(pool *upstreamPool, n int, addr string, cookie string) string {
+	var got string
+	for i := 0; i < n; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr + ":1234"
+		if cookie != "" {
+			r.Header.Set("Cookie", pool.cookieName+"="+cookie)
+		}
+		got += pool.pick(r).URL[len("http://"):][:1]
+	}
+	return got
+}
+
+func eject(pool *upstreamPool, i int) {
+	for n := 0; n < pool.maxFails; n++ {
+		pool.recordFailure(pool.targets[i], errors.New("connection refused"))
+	}
+}
+
+func TestUpstreamPoolStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		ejected  []int
+		active   []int64
+		addr     string
+		cookie   int // index of the target pinned by cookie, or -1
+		want     string
+	}{
+		{"round robin", lbRoundRobin, nil, nil, "192.0.2.1", -1, "abcabc"},
+		{"round robin skips ejected", "", []int{1}, nil, "192.0.2.1", -1, "acacac"},
+		{"least connections", lbLeastConnections, nil, []int64{2, 1, 3}, "192.0.2.1", -1, "bbbbbb"},
+		{"least connections skips ejected", lbLeastConnections, []int{1}, []int64{2, 1, 3}, "192.0.2.1", -1, "aaaaaa"},
+		{"random among available", lbRandom, []int{0, 2}, nil, "192.0.2.1", -1, "bbbbbb"},
+		{"ip hash", lbIPHash, nil, nil, "192.0.2.1", -1, "bbbbbb"},
+		{"ip hash moves on from ejected", lbIPHash, []int{1}, nil, "192.0.2.1", -1, "cccccc"},
+		{"ip hash of another client", lbIPHash, nil, nil, "192.0.2.5", -1, "aaaaaa"},
+		{"cookie", lbCookie, nil, nil, "192.0.2.1", 2, "cccccc"},
+		{"cookie of ejected target", lbCookie, []int{2}, nil, "192.0.2.1", 2, "ababab"},
+		{"unknown cookie", lbCookie, nil, nil, "192.0.2.1", -1, "abcabc"},
+		{"all ejected", lbRoundRobin, []int{0, 1, 2}, nil, "192.0.2.1", -1, "abcabc"},
+	}
+	for _, tt := range tests {
+		pool := testPool(t, &LoadBalancing{Strategy: tt.strategy})
+		for _, i := range tt.ejected {
+			eject(pool, i)
+		}
+		for i, n := range tt.active {
+			pool.targets[i].active = n
+		}
+		cookie := ""
+		if tt.cookie >= 0 {
+			cookie = pool.targets[tt.cookie].ID
+		}
+		if got := picks(pool, 6, tt.addr, cookie); got != tt.want {
+			t.Errorf("%s: picked %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := newUpstreamPool("app.example.com", []string{"http://a.internal"}, &LoadBalancing{Strategy: "fastest"}, false, nil); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestUpstreamEjection(t *testing.T) {
+	pool := testPool(t, &LoadBalancing{MaxFails: 2, FailTimeout: Duration(time.Minute)})
+	a := pool.targets[0]
+	fail := func() { pool.recordFailure(a, errors.New("status 502")) }
+
+	fail()
+	if !pool.available(a) {
+		t.Fatal("ejected before max_fails")
+	}
+	pool.recordSuccess(a)
+	fail()
+	if !pool.available(a) {
+		t.Fatal("success didn't reset the failure count")
+	}
+
+	// Failures further apart than fail_timeout don't add up
+	a.firstFail = time.Now().Add(-2 * time.Minute)
+	fail()
+	if !pool.available(a) {
+		t.Fatal("ejected for failures outside fail_timeout")
+	}
+
+	fail()
+	if pool.available(a) {
+		t.Fatal("not ejected after max_fails within fail_timeout")
+	}
+	if until := time.Until(a.ejectedUntil); until > time.Minute || until < time.Minute-time.Second {
+		t.Errorf("ejected for %v", until)
+	}
+
+	// Further failures while ejected don't extend the ejection
+	ejectedUntil := a.ejectedUntil
+	fail()
+	if a.ejectedUntil != ejectedUntil {
+		t.Error("ejection extended")
+	}
+
+	// Readmitted once fail_timeout passes, keeping its state across reloads
+	reloaded, err := newUpstreamPool("app.example.com", []string{"http://a.internal", "http://b.internal"}, nil, false, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.available(reloaded.targets[0]) {
+		t.Error("reload readmitted an ejected target")
+	}
+	reloaded.targets[0].ejectedUntil = time.Now().Add(-time.Millisecond)
+	if !reloaded.available(reloaded.targets[0]) {
+		t.Error("not readmitted after fail_timeout")
+	}
+
+	// The only target of a proxy is never ejected
+	single, _ := newUpstreamPool("app.example.com", []string{"http://a.internal"}, nil, false, nil)
+	eject(single, 0)
+	if !single.available(single.targets[0]) {
+		t.Error("only target ejected")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LogFile configures a log written to disk. Once the file reaches MaxSizeMB it
+// is renamed to <path>.1, shifting older files up, and MaxFiles of them are
+// kept.
+type LogFile struct {
+	// Defaults to a file next to config.json
+	Path      string `json:"path,omitempty"`
+	MaxSizeMB int    `json:"max_size_mb,omitempty"` // defaults to 10
+	MaxFiles  int    `json:"max_files,omitempty"`   // defaults to 5
+	// Also write every line to stdout
+	Stdout bool `json:"stdout,omitempty"`
+}
+
+const (
+	defaultLogMaxSizeMB = 10
+	defaultLogMaxFiles  = 5
+)
+
+// rotatingFile is an io.Writer appending to a size-rotated file. Each Write
+// should be one complete line so lines are never split across files.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	stdout   bool
+	f        *os.File
+	size     int64
+}
+
+var (
+	logFilesMu sync.Mutex
+	logFiles   = make(map[string]*rotatingFile) // by path
+)
+
+// logFileSet collects the log files of a config being loaded. Logs writing
+// to the same path share one writer, so they don't rotate the file from under
+// each other and a config reload doesn't reopen it. The shared writers only
+// take the new settings once the config is accepted.
+type logFileSet struct {
+	files    map[string]*rotatingFile // by path
+	settings map[*rotatingFile]logFileSettings
+}
+
+type logFileSettings struct {
+	maxSize  int64
+	maxFiles int
+	stdout   bool
+}
+
+func newLogFileSet() *logFileSet {
+	return &logFileSet{
+		files:    make(map[string]*rotatingFile),
+		settings: make(map[*rotatingFile]logFileSettings),
+	}
+}
+
+// open returns the writer for conf.
+func (set *logFileSet) open(conf LogFile, defaultName string) *rotatingFile {
+	path := conf.Path
+	if path == "" {
+		path = getDataPath(defaultName)
+	}
+	maxSize := int64(conf.MaxSizeMB) << 20
+	if maxSize <= 0 {
+		maxSize = defaultLogMaxSizeMB << 20
+	}
+	maxFiles := conf.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = defaultLogMaxFiles
+	}
+
+	rf, found := set.files[path]
+	if !found {
+		logFilesMu.Lock()
+		rf, found = logFiles[path]
+		logFilesMu.Unlock()
+		if !found {
+			rf = &rotatingFile{path: path}
+		}
+		set.files[path] = rf
+	}
+	set.settings[rf] = logFileSettings{maxSize: maxSize, maxFiles: maxFiles, stdout: conf.Stdout}
+	return rf
+}
+
+// apply gives the writers their settings and makes them the shared writers
+// of their paths.
+func (set *logFileSet) apply() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	for path, rf := range set.files {
+		settings := set.settings[rf]
+		rf.mu.Lock()
+		rf.maxSize, rf.maxFiles, rf.stdout = settings.maxSize, settings.maxFiles, settings.stdout
+		rf.mu.Unlock()
+		logFiles[path] = rf
+	}
+}
+
+// closeUnused closes the shared log files not in the set anymore, e.g. of
+// proxies removed or renamed by a config reload.
+func (set *logFileSet) closeUnused() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	for path, rf := range logFiles {
+		if set.files[path] != rf {
+			rf.Close()
+			delete(logFiles, path)
+		}
+	}
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.stdout {
+		os.Stdout.Write(p)
+	}
+
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// open opens the current file for appending. rf.mu must be held.
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts <path>.N up by one, dropping the oldest, and starts a new
+// file. rf.mu must be held.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxFiles))
+	for i := rf.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.open()
+}
+
+// files lists the log files, newest first.
+func (rf *rotatingFile) files() []string {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	files := []string{rf.path}
+	for i := 1; i <= rf.maxFiles; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", rf.path, i))
+	}
+	return files
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLogFileSetAppliesOnlyWhenAccepted(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "access.log")
+	removed := filepath.Join(dir, "removed.log")
+	logFilesMu.Lock()
+	saved := logFiles
+	logFiles = make(map[string]*rotatingFile)
+	logFilesMu.Unlock()
+	defer func() {
+		logFilesMu.Lock()
+		logFiles = saved
+		logFilesMu.Unlock()
+	}()
+
+	live := newLogFileSet()
+	rf := live.open(LogFile{Path: shared, MaxSizeMB: 1}, "")
+	old := live.open(LogFile{Path: removed}, "")
+	live.apply()
+	if _, err := old.Write([]byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A config rejected after opening its logs changes nothing
+	rejected := newLogFileSet()
+	if rejected.open(LogFile{Path: shared, MaxSizeMB: 2, Stdout: true}, "") != rf {
+		t.Fatal("writer of the same path not shared")
+	}
+	rejected.open(LogFile{Path: filepath.Join(dir, "new.log")}, "")
+	if rf.maxSize != 1<<20 || rf.stdout {
+		t.Errorf("rejected config changed the live writer: %d bytes, stdout %v", rf.maxSize, rf.stdout)
+	}
+	logFilesMu.Lock()
+	registered := len(logFiles)
+	logFilesMu.Unlock()
+	if registered != 2 {
+		t.Errorf("%d log files registered, want 2", registered)
+	}
+
+	accepted := newLogFileSet()
+	accepted.open(LogFile{Path: shared, MaxSizeMB: 2, MaxFiles: 3}, "")
+	accepted.apply()
+	accepted.closeUnused()
+	if rf.maxSize != 2<<20 || rf.maxFiles != 3 {
+		t.Errorf("accepted config not applied: %d bytes, %d files", rf.maxSize, rf.maxFiles)
+	}
+	if old.f != nil {
+		t.Error("log file of the old config left open")
+	}
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	if len(logFiles) != 1 || logFiles[shared] != rf {
+		t.Errorf("registered log files %v", logFiles)
+	}
+}
@@ -3,21 +3,23 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/sessions"
@@ -40,46 +42,246 @@ type OAuthProvider struct {
 	UserInfoURL  string   `json:"user_info_url,omitempty"`
 }
 
+// Duration is a time.Duration that can be written in config either as a Go
+// duration string ("15m", "12h") or as a number of nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(value))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+	return nil
+}
+
+// AllowedUser is an allowed_users entry of a proxy. It is written as a plain
+// email address, or as an object when the grant is limited in time:
+//
+//	{"email": "friend@example.com", "expires": "2026-01-31T00:00:00Z"}
+type AllowedUser struct {
+	Email     string     `json:"email"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+func (u AllowedUser) MarshalJSON() ([]byte, error) {
+	if u.NotBefore == nil && u.Expires == nil {
+		return json.Marshal(u.Email)
+	}
+	type allowedUser AllowedUser
+	return json.Marshal(allowedUser(u))
+}
+
+func (u *AllowedUser) UnmarshalJSON(b []byte) error {
+	var email string
+	if err := json.Unmarshal(b, &email); err == nil {
+		*u = AllowedUser{Email: email}
+		return nil
+	}
+	type allowedUser AllowedUser
+	return json.Unmarshal(b, (*allowedUser)(u))
+}
+
+// activeAt reports whether the grant is in effect at t.
+func (u AllowedUser) activeAt(t time.Time) bool {
+	if u.NotBefore != nil && t.Before(*u.NotBefore) {
+		return false
+	}
+	if u.Expires != nil && !t.Before(*u.Expires) {
+		return false
+	}
+	return true
+}
+
+// expiredAt reports whether the grant has ended for good at t.
+func (u AllowedUser) expiredAt(t time.Time) bool {
+	return u.Expires != nil && !t.Before(*u.Expires)
+}
+
 type Config struct {
-	TLDN               string                   `json:"tldn"`
-	AllowedUsers       []string                 `json:"allowed_users"`
-	AdminPasswordHash  string                   `json:"admin_password_hash"`
-	InsecureSkipVerify bool                     `json:"insecure_skip_verify"`
+	TLDN               string   `json:"tldn"`
+	AllowedUsers       []string `json:"allowed_users"`
+	AdminPasswordHash  string   `json:"admin_password_hash"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
 	Proxies            []struct {
-		Internal              string   `json:"internal"`
-		External              string   `json:"external"`
-		AllowedUsers          []string `json:"allowed_users"`
-		UnauthenticatedRoutes []string `json:"unauthenticated_routes"`
+		Internal string `json:"internal"`
+		// More upstreams next to Internal, balanced per LoadBalancing
+		Targets       []string       `json:"targets,omitempty"`
+		LoadBalancing *LoadBalancing `json:"load_balancing,omitempty"`
+		External      string         `json:"external"`
+		// More hosts served by this same entry, wildcards allowed
+		Aliases []string `json:"aliases,omitempty"`
+		// Answers every request with a redirect instead of proxying
+		Redirect *Redirect `json:"redirect,omitempty"`
+		// Serves a local directory instead of proxying
+		Static *StaticSite `json:"static,omitempty"`
+		// Request and response header changes, e.g. security headers
+		Headers *HeaderRules `json:"headers,omitempty"`
+		// Ordered regex rewrites of request URLs, applied before forwarding
+		Rewrites              []RewriteRule `json:"rewrites,omitempty"`
+		AllowedUsers          []AllowedUser `json:"allowed_users"`
+		UnauthenticatedRoutes []string      `json:"unauthenticated_routes"`
+		// GitHub organization logins and "org/team-slug" pairs whose members
+		// are allowed in addition to AllowedUsers
+		AllowedGithubOrgs  []string `json:"allowed_github_orgs,omitempty"`
+		AllowedGithubTeams []string `json:"allowed_github_teams,omitempty"`
+		// OAuth provider keys accepted for this proxy; empty allows all
+		AllowedProviders []string `json:"allowed_providers,omitempty"`
+		// Sessions authenticated longer ago than this must log in again
+		MaxAuthAge Duration `json:"max_auth_age,omitempty"`
+		// Client address rules applied in addition to the global ones
+		IPRules IPRules `json:"ip_rules,omitempty"`
+		// Per client limit applied in addition to the global one
+		RateLimit *RateLimit `json:"rate_limit,omitempty"`
+		// Logs this proxy's requests to its own file instead of the global
+		// access log
+		AccessLog *AccessLog `json:"access_log,omitempty"`
+		// Active checks of Internal, failing ones show a "service is down" page
+		HealthCheck *HealthCheck `json:"health_check,omitempty"`
+		// Paths sent to other upstreams or with their own access policy
+		Routes []Route `json:"routes,omitempty"`
 	} `json:"proxies"`
-	SessionKey         string                   `json:"session_key"`
-	CookieExpire       time.Duration            `json:"cookie_expire"`
-	
+	SessionKey   string        `json:"session_key"`
+	CookieExpire time.Duration `json:"cookie_expire"`
+
 	// Deprecated: Kept for backwards compatibility
-	OAuth              struct {
+	OAuth struct {
 		Auth_URL      string `json:"auth_url"`
 		Client_ID     string `json:"client_id"`
 		Client_Secret string `json:"client_secret"`
 		Redirect_URL  string `json:"redirect_url"`
 	} `json:"oauth"`
 
-	OAuthProviders     map[string]OAuthProvider `json:"oauth_providers"`
+	OAuthProviders map[string]OAuthProvider `json:"oauth_providers"`
+
+	// How long GitHub org/team memberships cached in the session are trusted
+	// before being re-fetched from the GitHub API. Defaults to 15 minutes.
+	GithubGroupsRefresh Duration `json:"github_groups_refresh,omitempty"`
+
+	// Lifetime of tokens issued through the device authorization flow.
+	// Defaults to 30 days.
+	DeviceTokenTTL Duration `json:"device_token_ttl,omitempty"`
+
+	// URL that admin notifications such as new access requests are POSTed to
+	AdminNotifyWebhook string `json:"admin_notify_webhook,omitempty"`
+
+	// Users who may log in to the admin panel through the OAuth providers,
+	// with their roles. When set, the basic auth admin account is only accepted if
+	// AdminBasicAuthFallback is enabled.
+	Admins                 []AdminEntry `json:"admins,omitempty"`
+	AdminBasicAuthFallback bool         `json:"admin_basic_auth_fallback,omitempty"`
+	// Base URL of the admin panel, defaults to http://<tldn>:3001
+	AdminURL string `json:"admin_url,omitempty"`
+
+	// Client address rules applied to every proxy
+	IPRules IPRules `json:"ip_rules,omitempty"`
+	// Networks of reverse proxies in front of Pylon whose X-Forwarded-For
+	// and X-Real-IP headers are trusted for the client address
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// Per client request limits, keyed by email for logged in users and by
+	// client address otherwise. AuthRateLimit covers the /pylon/ login
+	// endpoints and defaults to 1 request per second with bursts of 20.
+	RateLimit     *RateLimit `json:"rate_limit,omitempty"`
+	AuthRateLimit *RateLimit `json:"auth_rate_limit,omitempty"`
+
+	// Structured log of logins and access decisions, written to auth.log
+	// next to config.json by default
+	AuthLog LogFile `json:"auth_log,omitempty"`
+
+	// Log of every request on the proxy listener, off unless set
+	AccessLog *AccessLog `json:"access_log,omitempty"`
+
+	// Address of a dedicated listener serving /metrics, /healthz and
+	// /readyz without authentication, e.g. ":9090". Read at startup only.
+	MetricsListen string `json:"metrics_listen,omitempty"`
+
+	// Export of login flow and proxied request spans to an OpenTelemetry
+	// collector, off unless set
+	Tracing *Tracing `json:"tracing,omitempty"`
 }
 
 type ProxyServer struct {
 	redirect_server *http.Server
 	server          *http.Server
 	wg              *sync.WaitGroup
+	// Set once the HTTPS listener is accepting connections
+	listening int32
+}
+
+func (ps *ProxyServer) isReady() bool {
+	return atomic.LoadInt32(&ps.listening) == 1
 }
 
 type ProxyDetails struct {
+	// Name of the proxy, shared by its aliases
+	External                   string
 	Internal                   string
-	AllowedUsers               []string               `json:"allowed_users"`
+	AllowedUsers               []AllowedUser `json:"allowed_users"`
+	AllowedGithubOrgs          []string
+	AllowedGithubTeams         []string
+	AllowedProviders           []string
+	MaxAuthAge                 time.Duration
+	IPRules                    ipRuleSet
+	RateLimiter                *rateLimiter
+	AccessLog                  *accessLogger
 	UnauthenticatedRoutesRegex *regexp.Regexp
-	ReverseProxy               *httputil.ReverseProxy
+	Redirect                   *Redirect
+	Static                     *staticSite
+	Headers                    *HeaderRules
+	Rewrites                   []*rewriteRule
+	Upstreams                  *upstreamPool
+	Routes                     []*proxyRoute
+	// Set on the details of routes
+	StripPrefix string
+	Public      bool
+	// The route has its own allowed users, which access requests can't
+	// grant since they add users to the proxy
+	RoutePolicy bool
+}
+
+// authIdentity is the authenticated user as recorded in the pylon session.
+type authIdentity struct {
+	Email    string
+	Provider string
+	AuthTime time.Time
+	// TokenID is set when authenticated with a Pylon bearer token
+	TokenID     string
+	GithubOrgs  []string
+	GithubTeams []string
+	// GithubStale is set when cached GitHub memberships are past their
+	// refresh interval and could not be re-fetched.
+	GithubStale bool
 }
 
 type AppListResponse struct {
 	Apps []string `json:"apps"`
+	// Health of the apps with health checks, by app
+	Health map[string]AppHealth `json:"health,omitempty"`
+}
+
+// AppHealth is the status of an app's upstreams shown to its users. Targets
+// and errors are only shown to admins, on /upstream-health.
+type AppHealth struct {
+	Status string `json:"status"`
 }
 
 var (
@@ -89,8 +291,35 @@ var (
 	proxiesMu sync.RWMutex
 	proxies   map[string]*ProxyDetails
 	server    = &ProxyServer{wg: &sync.WaitGroup{}}
+
+	// Proxies with wildcard externals in config order, guarded by proxiesMu
+	wildcardProxies []wildcardProxy
+	// Every proxy by its external, wildcards included, guarded by proxiesMu
+	proxiesByName map[string]*ProxyDetails
+
+	// Compiled from cfg by loadConfig, guarded by cfgMu
+	globalIPRules     ipRuleSet
+	trustedProxies    []*net.IPNet
+	globalRateLimiter *rateLimiter
+	authRateLimiter   *rateLimiter
+	// Lower cased orgs and teams some proxy or route allows
+	githubGroupsInUse map[string]bool
+
+	// GitHub access tokens by email, kept server side so org/team
+	// memberships can be refreshed without a new login
+	githubTokensMu sync.Mutex
+	githubTokens   = make(map[string]githubToken)
 )
 
+// githubTokenLifetime is how long a GitHub token is kept for refreshing
+// memberships: as long as a session cookie is accepted.
+const githubTokenLifetime = 30 * 24 * time.Hour
+
+type githubToken struct {
+	token    *oauth2.Token
+	storedAt time.Time
+}
+
 func main() {
 	// CLI Password Hashing Helper
 	hashPass := flag.String("hash", "", "Generate a bcrypt hash of the specified password and exit")
@@ -110,18 +339,54 @@ func main() {
 		log.Fatalf("Failed to load initial config: %v", err)
 	}
 
+	if err := loadTokens(); err != nil {
+		log.Fatalf("Failed to load token store: %v", err)
+	}
+	revokeUnauthorizedTokens()
+	go pruneExpiredGrants()
+	if err := loadAccessRequests(); err != nil {
+		log.Fatalf("Failed to load access requests: %v", err)
+	}
+
 	// Frontend handler and api endpoint (port :3001)
 	frontend := http.NewServeMux()
 	fs := http.FileServer(http.Dir("frontend"))
 	frontend.Handle("/", fs)
 	frontend.HandleFunc("/config", ConfigHandler)
+	frontend.HandleFunc("/tokens", TokensHandler)
+	frontend.HandleFunc("/access-requests", AccessRequestsHandler)
+	frontend.HandleFunc("/bans", BansHandler)
+	frontend.HandleFunc("/admin-logout", AdminLogoutHandler)
+	frontend.HandleFunc("/audit", AuditHandler)
+	frontend.HandleFunc("/auth-events", AuthEventsHandler)
+	frontend.HandleFunc("/metrics", MetricsHandler)
+	frontend.HandleFunc("/upstream-health", UpstreamHealthHandler)
 
 	// Start Proxy Server (ports :http and :https)
 	server.startServer()
 
-	// Serve Frontend with Basic Auth Middleware
+	cfgMu.RLock()
+	metricsListen := cfg.MetricsListen
+	cfgMu.RUnlock()
+	if metricsListen != "" {
+		metrics := http.NewServeMux()
+		metrics.HandleFunc("/metrics", MetricsHandler)
+		metrics.HandleFunc("/healthz", HealthzHandler)
+		metrics.HandleFunc("/readyz", ReadyzHandler)
+		go func() {
+			log.Printf("Serving metrics on %s...", metricsListen)
+			log.Fatal(http.ListenAndServe(metricsListen, metrics))
+		}()
+	}
+
+	// Serve Frontend with Admin Auth Middleware
 	log.Printf("Serving admin panel on port :3001...")
-	log.Fatal(http.ListenAndServe(":3001", basicAuthMiddleware(frontend)))
+	admin := http.NewServeMux()
+	admin.HandleFunc("/admin-callback", AdminCallbackHandler)
+	admin.HandleFunc("/healthz", HealthzHandler)
+	admin.HandleFunc("/readyz", ReadyzHandler)
+	admin.Handle("/", adminAuthMiddleware(frontend))
+	log.Fatal(http.ListenAndServe(":3001", admin))
 }
 
 func getConfigPath() string {
@@ -132,30 +397,20 @@ func getConfigPath() string {
 	return configPath
 }
 
-func loadConfig() error {
-	configPath := getConfigPath()
+// readConfigFile reads the config file as written, without the environment
+// overrides applied by loadConfig.
+func readConfigFile() (Config, error) {
 	var conf Config
-
-	f, err := os.ReadFile(configPath)
+	f, err := os.ReadFile(getConfigPath())
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Initialize with empty default config for onboarding
-			conf = Config{
-				SessionKey:     generateState(), // generate a random default key
-				CookieExpire:   24 * time.Hour,
-				OAuthProviders: make(map[string]OAuthProvider),
-			}
-		} else {
-			return err
-		}
-	} else {
-		err = json.Unmarshal(f, &conf)
-		if err != nil {
-			return err
-		}
+		return conf, err
 	}
+	err = json.Unmarshal(f, &conf)
+	return conf, err
+}
 
-	// Bind environment variables as overrides/fallbacks
+// Bind environment variables as overrides/fallbacks
+func applyEnvOverrides(conf *Config) {
 	if os.Getenv("PYLON_TLDN") != "" {
 		conf.TLDN = os.Getenv("PYLON_TLDN")
 	}
@@ -170,6 +425,54 @@ func loadConfig() error {
 			conf.AdminPasswordHash = string(hash)
 		}
 	}
+}
+
+func googleFromEnv() bool {
+	return os.Getenv("GOOGLE_CLIENT_ID") != "" && os.Getenv("GOOGLE_CLIENT_SECRET") != ""
+}
+
+// removeEnvOverrides puts back the file's own values of everything the
+// environment overrides, so secrets passed in the environment are never
+// written to the config file.
+func removeEnvOverrides(conf *Config, file Config) {
+	if os.Getenv("PYLON_TLDN") != "" {
+		conf.TLDN = file.TLDN
+	}
+	if os.Getenv("PYLON_SESSION_KEY") != "" {
+		conf.SessionKey = file.SessionKey
+	}
+	if os.Getenv("PYLON_ADMIN_PASSWORD_HASH") != "" || os.Getenv("PYLON_ADMIN_PASSWORD") != "" {
+		conf.AdminPasswordHash = file.AdminPasswordHash
+	}
+	if googleFromEnv() {
+		providers := make(map[string]OAuthProvider)
+		for key, p := range conf.OAuthProviders {
+			providers[key] = p
+		}
+		if p, found := file.OAuthProviders["google"]; found {
+			providers["google"] = p
+		} else {
+			delete(providers, "google")
+		}
+		conf.OAuthProviders = providers
+	}
+}
+
+func loadConfig() (err error) {
+	defer func() { recordConfigReload(err) }()
+
+	conf, err := readConfigFile()
+	if os.IsNotExist(err) {
+		// Initialize with empty default config for onboarding
+		conf = Config{
+			SessionKey:     generateState(), // generate a random default key
+			CookieExpire:   24 * time.Hour,
+			OAuthProviders: make(map[string]OAuthProvider),
+		}
+	} else if err != nil {
+		return err
+	}
+	applyEnvOverrides(&conf)
 
 	// Initialize OAuthProviders map if empty
 	if conf.OAuthProviders == nil {
@@ -190,7 +493,7 @@ func loadConfig() error {
 	}
 
 	// Environment variable Google OAuth binding fallback
-	if os.Getenv("GOOGLE_CLIENT_ID") != "" && os.Getenv("GOOGLE_CLIENT_SECRET") != "" {
+	if googleFromEnv() {
 		conf.OAuthProviders["google"] = OAuthProvider{
 			ID:           "google",
 			Name:         "Google",
@@ -203,42 +506,174 @@ func loadConfig() error {
 	}
 
 	// Build proxies lookup map
+	proxiesMu.RLock()
+	oldProxies := proxiesByName
+	proxiesMu.RUnlock()
+
 	newProxies := make(map[string]*ProxyDetails)
+	newProxiesByName := make(map[string]*ProxyDetails)
+	var newWildcardProxies []wildcardProxy
+	logs := newLogFileSet()
+	hostOwners := make(map[string]string) // every external and alias, to the external it belongs to
 	for _, p := range conf.Proxies {
+		targets := upstreamTargets(p.Internal, p.Targets)
+		for _, route := range p.Routes {
+			targets = append(targets, upstreamTargets(route.Internal, route.Targets)...)
+		}
+		hosts := append([]string{p.External}, p.Aliases...)
+		for _, host := range hosts {
+			if owner, taken := hostOwners[host]; taken {
+				return fmt.Errorf("host %s is configured for both %s and %s", host, owner, p.External)
+			}
+			hostOwners[host] = p.External
+			if err := checkHostTemplates(host, targets); err != nil {
+				return err
+			}
+			if p.Redirect != nil {
+				if err := p.Redirect.validate(host); err != nil {
+					return err
+				}
+			}
+		}
+
 		unauthenticatedRegex, err := regexp.Compile(strings.Join(p.UnauthenticatedRoutes, "|"))
 		if err != nil {
 			return fmt.Errorf("invalid unauthenticated routes regex: %v", err)
 		}
 
-		u, err := url.Parse(p.Internal)
+		ipRules, err := compileIPRules(p.IPRules)
 		if err != nil {
-			return fmt.Errorf("invalid internal URL %q: %v", p.Internal, err)
+			return fmt.Errorf("invalid ip rules for %s: %v", p.External, err)
 		}
 
-		rp := httputil.NewSingleHostReverseProxy(u)
-		rp.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: conf.InsecureSkipVerify,
-			},
+		rewrites, err := compileRewrites(p.External, p.Rewrites)
+		if err != nil {
+			return err
 		}
 
-		newProxies[p.External] = &ProxyDetails{
+		var oldUpstreams *upstreamPool
+		var oldRateLimiter *rateLimiter
+		old, hadProxy := oldProxies[p.External]
+		if hadProxy {
+			oldUpstreams = old.Upstreams
+			oldRateLimiter = old.RateLimiter
+		}
+		proxyAccessLog, err := newAccessLogger(logs, p.AccessLog, "access-"+p.External+".log")
+		if err != nil {
+			return fmt.Errorf("invalid access log for %s: %v", p.External, err)
+		}
+
+		if p.Redirect != nil && p.Static != nil {
+			return fmt.Errorf("%s can't both redirect and serve a static site", p.External)
+		}
+		var static *staticSite
+		if p.Static != nil {
+			if static, err = newStaticSite(p.External, p.Static); err != nil {
+				return err
+			}
+		}
+
+		// Redirect-only entries and static sites have no upstreams
+		var upstreams *upstreamPool
+		if p.Redirect == nil && p.Static == nil {
+			upstreams, err = newUpstreamPool(p.External, upstreamTargets(p.Internal, p.Targets), p.LoadBalancing, conf.InsecureSkipVerify, oldUpstreams)
+			if err != nil {
+				return err
+			}
+		}
+
+		pd := &ProxyDetails{
+			External:                   p.External,
 			Internal:                   p.Internal,
 			AllowedUsers:               p.AllowedUsers,
+			AllowedGithubOrgs:          p.AllowedGithubOrgs,
+			AllowedGithubTeams:         p.AllowedGithubTeams,
+			AllowedProviders:           p.AllowedProviders,
+			MaxAuthAge:                 time.Duration(p.MaxAuthAge),
+			IPRules:                    ipRules,
+			RateLimiter:                reuseRateLimiter(oldRateLimiter, p.RateLimit),
+			AccessLog:                  proxyAccessLog,
 			UnauthenticatedRoutesRegex: unauthenticatedRegex,
-			ReverseProxy:               rp,
+			Redirect:                   p.Redirect,
+			Static:                     static,
+			Headers:                    p.Headers,
+			Rewrites:                   rewrites,
+			Upstreams:                  upstreams,
+		}
+		if p.Redirect == nil {
+			if pd.Routes, err = compileRoutes(p.External, pd, p.Routes, conf.InsecureSkipVerify, old); err != nil {
+				return err
+			}
+		}
+
+		newProxiesByName[p.External] = pd
+		for _, host := range hosts {
+			if !isWildcardHost(host) {
+				newProxies[host] = pd
+				continue
+			}
+			pattern, err := compileHostPattern(host)
+			if err != nil {
+				return err
+			}
+			newWildcardProxies = append(newWildcardProxies, wildcardProxy{pattern: pattern, details: pd})
 		}
 	}
 
+	newGlobalIPRules, err := compileIPRules(conf.IPRules)
+	if err != nil {
+		return fmt.Errorf("invalid global ip rules: %v", err)
+	}
+	newTrustedProxies, err := parseNetworks(conf.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+
+	cfgMu.RLock()
+	oldGlobalRateLimiter, oldAuthRateLimiter := globalRateLimiter, authRateLimiter
+	cfgMu.RUnlock()
+	newGlobalAccessLog, err := newAccessLogger(logs, conf.AccessLog, "access.log")
+	if err != nil {
+		return fmt.Errorf("invalid access log: %v", err)
+	}
+
+	newAuthLog := logs.open(conf.AuthLog, "auth.log")
+
+	authLimit := conf.AuthRateLimit
+	if authLimit == nil {
+		authLimit = &defaultAuthRateLimit
+	}
+
+	// The config is accepted: only now may it change the live logs
+	logs.apply()
+
 	cfgMu.Lock()
 	cfg = conf
 	store = sessions.NewCookieStore([]byte(conf.SessionKey))
+	globalIPRules = newGlobalIPRules
+	trustedProxies = newTrustedProxies
+	githubGroupsInUse = githubGroupsOf(newProxiesByName)
+	globalRateLimiter = reuseRateLimiter(oldGlobalRateLimiter, conf.RateLimit)
+	authRateLimiter = reuseRateLimiter(oldAuthRateLimiter, authLimit)
+	authLog = newAuthLog
+	accessLog = newGlobalAccessLog
 	cfgMu.Unlock()
 
+	tracer.configure(conf.Tracing)
+	startHealthChecks(conf)
+
 	proxiesMu.Lock()
 	proxies = newProxies
+	wildcardProxies = newWildcardProxies
+	proxiesByName = newProxiesByName
 	proxiesMu.Unlock()
 
+	// Close the files of logs that were removed or moved
+	logs.closeUnused()
+
+	// Tokens must not outlive their owner's access
+	revokeUnauthorizedTokens()
+
 	return nil
 }
 
@@ -251,7 +686,7 @@ func getSessionStore() *sessions.CookieStore {
 func isOnboardingMode() bool {
 	cfgMu.RLock()
 	defer cfgMu.RUnlock()
-	return cfg.AdminPasswordHash == "" || len(cfg.OAuthProviders) == 0
+	return (cfg.AdminPasswordHash == "" && len(cfg.Admins) == 0) || len(cfg.OAuthProviders) == 0
 }
 
 func isAllowedDomain(host string) bool {
@@ -267,24 +702,46 @@ func isAllowedDomain(host string) bool {
 		}
 	}
 
+	_, exists := lookupProxy(host)
+	return exists
+}
+
+// lookupProxyByName finds a configured proxy by its external, which for
+// wildcard proxies is the pattern rather than a host.
+func lookupProxyByName(external string) (*ProxyDetails, bool) {
 	proxiesMu.RLock()
 	defer proxiesMu.RUnlock()
-	_, exists := proxies[host]
-	return exists
+	pd, found := proxiesByName[external]
+	return pd, found
 }
 
+// lookupProxy finds the proxy for a host: the one with that exact external,
+// or else the first wildcard proxy matching it.
 func lookupProxy(host string) (*ProxyDetails, bool) {
 	proxiesMu.RLock()
 	defer proxiesMu.RUnlock()
-	pd, found := proxies[host]
-	return pd, found
+	if pd, found := proxies[host]; found {
+		return pd, true
+	}
+	return lookupWildcardProxy(host)
 }
 
-func basicAuthMiddleware(next http.Handler) http.Handler {
+// adminAuthMiddleware protects the admin panel. Admins listed in the config
+// log in through the OAuth providers; the shared basic auth account is used
+// when no admins are configured, or as a break-glass fallback if enabled.
+func adminAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The admin cookie is Lax, so apps on sibling hosts can make the
+		// browser send it: changes only come from the panel's own pages
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" && !sameOrigin(r, adminOrigin()) {
+			log.Printf("Refused admin %s %s from %s: foreign origin %q", r.Method, r.URL.Path, clientIP(r), r.Header.Get("Origin"))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
 		// Bypass authentication if in Onboarding Mode
 		if isOnboardingMode() {
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, withAdmin(r, AdminEntry{Role: adminRoleOwner}))
 			return
 		}
 
@@ -294,38 +751,88 @@ func basicAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		user, pass, ok := r.BasicAuth()
-
 		cfgMu.RLock()
-		hash := cfg.AdminPasswordHash
+		oauthAdmins := len(cfg.Admins) > 0
+		basicFallback := cfg.AdminBasicAuthFallback
 		cfgMu.RUnlock()
 
-		if !ok || user != "admin" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Pylon Admin Dashboard"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !oauthAdmins {
+			if admin, ok := checkAdminBasicAuth(w, r); ok {
+				next.ServeHTTP(w, withAdmin(r, admin))
+			}
+			return
+		}
+
+		session := getAdminSession(r)
+		email, _ := session.Values["admin_email"].(string)
+		if admin, found := lookupAdmin(email); found {
+			next.ServeHTTP(w, withAdmin(r, admin))
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		// Break-glass access with the basic auth account; ?break_glass
+		// makes the browser prompt for it
+		if basicFallback {
+			if _, _, hasBasic := r.BasicAuth(); hasBasic || r.URL.Query().Get("break_glass") != "" {
+				if admin, ok := checkAdminBasicAuth(w, r); ok {
+					log.Printf("Break-glass admin login from %s", clientIP(r))
+					next.ServeHTTP(w, withAdmin(r, admin))
+				}
+				return
+			}
+		}
+
+		cfgMu.RLock()
+		tldn := cfg.TLDN
+		cfgMu.RUnlock()
+		http.Redirect(w, r, "https://"+tldn+"/pylon/admin/login", http.StatusFound)
 	})
 }
 
+// checkAdminBasicAuth validates the basic auth admin account, writing a 401
+// or 429 response when it fails. The account has the owner role.
+func checkAdminBasicAuth(w http.ResponseWriter, r *http.Request) (AdminEntry, bool) {
+	// Throttle password guessing before spending time on bcrypt
+	addr := clientIP(r).String()
+	if banned := adminBanRemaining(addr); banned > 0 {
+		writeRateLimited(w, banned)
+		return AdminEntry{}, false
+	}
+
+	user, pass, ok := r.BasicAuth()
+
+	cfgMu.RLock()
+	hash := cfg.AdminPasswordHash
+	cfgMu.RUnlock()
+
+	if !ok || user != "admin" || hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		if ok {
+			ban := recordAdminFailure(addr)
+			log.Printf("Failed admin login for user %q from %s", user, addr)
+			emitAuthEvent(r, AuthEvent{Event: authEventLoginFailure, User: user, Provider: "basic_auth", Address: addr, Reason: "admin password rejected"})
+			if ban > 0 {
+				log.Printf("Banning %s from admin login for %v", addr, ban)
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Pylon Admin Dashboard"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return AdminEntry{}, false
+	}
+	recordAdminSuccess(addr)
+	return AdminEntry{Email: user, Role: adminRoleOwner}, true
+}
+
 func (ps *ProxyServer) startServer() {
 	proxy_mux := http.NewServeMux()
 
 	// Catch-all main handler for dynamic proxy routing and OAuth endpoints
-	proxy_mux.HandleFunc("/", mainProxyHandler)
+	proxy_mux.Handle("/", instrumentRequests(http.HandlerFunc(mainProxyHandler)))
 
 	// Create the autocert.Manager with dynamic HostPolicy
 	certManager := autocert.Manager{
-		Cache:  autocert.DirCache("/certs"),
-		Prompt: autocert.AcceptTOS,
-		HostPolicy: func(ctx context.Context, host string) error {
-			if isAllowedDomain(host) {
-				return nil
-			}
-			return fmt.Errorf("acme/autocert: host %q not configured", host)
-		},
+		Cache:      autocert.DirCache(certCacheDir),
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: certHostPolicy,
 	}
 
 	// Create the TLS proxy server
@@ -361,7 +868,14 @@ func (ps *ProxyServer) startServer() {
 	go func() {
 		// Serve HTTPS
 		defer ps.wg.Done()
-		err := ps.server.ListenAndServeTLS("", "")
+		ln, err := net.Listen("tcp", ps.server.Addr)
+		if err != nil {
+			log.Print("Error starting proxy server:", err)
+			return
+		}
+		atomic.StoreInt32(&ps.listening, 1)
+		defer atomic.StoreInt32(&ps.listening, 0)
+		err = ps.server.ServeTLS(ln, "", "")
 		if err != nil && err != http.ErrServerClosed {
 			log.Print("Error starting proxy server:", err)
 		}
@@ -371,6 +885,12 @@ func (ps *ProxyServer) startServer() {
 }
 
 func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
+	// Global client address deny and allow lists
+	if !globalIPRulesPermit(clientIP(r)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	// Handle CORS preflight options
 	if r.Method == "OPTIONS" {
 		enableCORS(&w, r)
@@ -378,6 +898,15 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Login endpoints get their own stricter per address limit
+	if strings.HasPrefix(r.URL.Path, "/pylon/auth/") || strings.HasPrefix(r.URL.Path, "/pylon/callback/") ||
+		strings.HasPrefix(r.URL.Path, "/pylon/device/") {
+		_, authLimiter := getGlobalRateLimiters()
+		if !checkRateLimits(w, "ip:"+clientIP(r).String(), authLimiter) {
+			return
+		}
+	}
+
 	// 1. Check if login gateway path
 	if r.URL.Path == "/pylon/login" {
 		loginGatewayHandler(w, r)
@@ -396,6 +925,38 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Device authorization flow for CLI access
+	if r.URL.Path == "/pylon/device/code" {
+		deviceCodeHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/pylon/device/token" {
+		deviceTokenHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/pylon/device" {
+		deviceVerifyHandler(w, r)
+		return
+	}
+
+	// Access requests from denied users
+	if r.URL.Path == "/pylon/access-request" {
+		accessRequestHandler(w, r)
+		return
+	}
+
+	// OAuth login to the admin panel
+	if r.URL.Path == "/pylon/admin/login" {
+		adminLoginHandler(w, r)
+		return
+	}
+
+	// Self-service personal access tokens
+	if r.URL.Path == "/pylon/tokens" {
+		personalTokensHandler(w, r)
+		return
+	}
+
 	// Check if GitHub App Manifest callback
 	if r.URL.Path == "/pylon/github/register" {
 		githubRegisterHandler(w, r)
@@ -408,13 +969,25 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Proxy Host Not Found", http.StatusNotFound)
 		return
 	}
+	requestInfoFrom(r).Proxy = pd
+	w = pd.Headers.wrap(w)
 
+	if pd.Redirect != nil {
+		pd.redirect(w, r)
+		return
+	}
 	pd.proxy(w, r)
 }
 
 func loginGatewayHandler(w http.ResponseWriter, r *http.Request) {
 	referer := r.URL.Query().Get("referer")
 
+	// Carry step-up re-authentication requests through to the provider
+	authQuery := "referer=" + url.QueryEscape(referer)
+	if maxAge := r.URL.Query().Get("max_age"); maxAge != "" {
+		authQuery += "&max_age=" + url.QueryEscape(maxAge)
+	}
+
 	cfgMu.RLock()
 	providersList := cfg.OAuthProviders
 	cfgMu.RUnlock()
@@ -426,25 +999,30 @@ func loginGatewayHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only offer the providers accepted by the proxy we were redirected from
+	providersList = providersForReferer(providersList, referer)
+	if len(providersList) == 0 {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.Error(w, "<h3>Error: None of the providers allowed for this resource are configured.</h3>", http.StatusInternalServerError)
+		return
+	}
+
 	// If exactly one provider is configured, bypass the gate and redirect directly
 	if len(providersList) == 1 {
 		for key := range providersList {
-			http.Redirect(w, r, fmt.Sprintf("/pylon/auth/%s?referer=%s", key, referer), http.StatusFound)
+			http.Redirect(w, r, fmt.Sprintf("/pylon/auth/%s?%s", key, authQuery), http.StatusFound)
 			return
 		}
 	}
 
 	// Render a beautifully designed glassmorphic login gate
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-
 	var buttonsHTML strings.Builder
 	for key, p := range providersList {
 		displayName := p.Name
 		if displayName == "" {
 			displayName = strings.Title(key)
 		}
-		
+
 		brandColor := "#4f46e5" // Default indigo
 		switch key {
 		case "google":
@@ -458,23 +1036,49 @@ func loginGatewayHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		buttonsHTML.WriteString(fmt.Sprintf(`
-			<a href="/pylon/auth/%s?referer=%s" class="login-btn" style="background-color: %s;">
+			<a href="/pylon/auth/%s?%s" class="login-btn" style="background-color: %s;">
 				<span>Login with %s</span>
 			</a>
-		`, key, referer, brandColor, displayName))
+		`, key, authQuery, brandColor, displayName))
 	}
 
-	html := fmt.Sprintf(`
+	writePylonPage(w, http.StatusOK, "Pylon Login Gateway", "Select a provider below to authenticate and access this resource.", buttonsHTML.String())
+}
+
+// writePylonPage renders content inside the glassmorphic Pylon page layout
+// shared by the login gateway and the other user facing /pylon/ pages.
+func writePylonPage(w http.ResponseWriter, status int, title string, subtitle string, content string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	page := fmt.Sprintf(`
 	<!DOCTYPE html>
 	<html lang="en">
 	<head>
 		<meta charset="UTF-8">
 		<meta name="viewport" content="width=device-width, initial-scale=1.0">
-		<title>Pylon Login Gateway</title>
-		<style>
+		<title>%s</title>
+		<style>%s</style>
+	</head>
+	<body>
+		<div class="container">
+			<h1>Pylon Gateway</h1>
+			<p>%s</p>
+			<div style="display: flex; flex-direction: column;">
+				%s
+			</div>
+		</div>
+	</body>
+	</html>
+	`, html.EscapeString(title), pylonPageStyle, html.EscapeString(subtitle), content)
+
+	w.Write([]byte(page))
+}
+
+const pylonPageStyle = `
 			body {
 				font-family: 'Inter', -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif;
-				background: linear-gradient(135deg, #0f172a 0%%, #1e293b 100%%);
+				background: linear-gradient(135deg, #0f172a 0%, #1e293b 100%);
 				color: #f8fafc;
 				display: flex;
 				justify-content: center;
@@ -489,7 +1093,7 @@ func loginGatewayHandler(w http.ResponseWriter, r *http.Request) {
 				border: 1px solid rgba(255, 255, 255, 0.1);
 				border-radius: 24px;
 				padding: 40px;
-				width: 100%%;
+				width: 100%;
 				max-width: 400px;
 				box-shadow: 0 20px 25px -5px rgb(0 0 0 / 0.5), 0 8px 10px -6px rgb(0 0 0 / 0.5);
 				text-align: center;
@@ -520,6 +1124,10 @@ func loginGatewayHandler(w http.ResponseWriter, r *http.Request) {
 				font-size: 15px;
 				transition: transform 0.2s, filter 0.2s;
 				box-shadow: 0 4px 6px -1px rgb(0 0 0 / 0.1);
+				border: none;
+				cursor: pointer;
+				width: 100%;
+				box-sizing: border-box;
 			}
 			.login-btn:hover {
 				transform: translateY(-2px);
@@ -528,21 +1136,44 @@ func loginGatewayHandler(w http.ResponseWriter, r *http.Request) {
 			.login-btn:active {
 				transform: translateY(0);
 			}
-		</style>
-	</head>
-	<body>
-		<div class="container">
-			<h1>Pylon Gateway</h1>
-			<p>Select a provider below to authenticate and access this resource.</p>
-			<div style="display: flex; flex-direction: column;">
-				%s
-			</div>
-		</div>
-	</body>
-	</html>
-	`, buttonsHTML.String())
+			.pylon-input {
+				padding: 12px 16px;
+				margin-bottom: 14px;
+				border-radius: 12px;
+				border: 1px solid rgba(255, 255, 255, 0.2);
+				background: rgba(15, 23, 42, 0.6);
+				color: #f8fafc;
+				font-size: 15px;
+				box-sizing: border-box;
+				width: 100%;
+			}
+			.pylon-list {
+				text-align: left;
+				color: #cbd5e1;
+				font-size: 14px;
+				margin: 0 0 24px 0;
+			}
+		`
 
-	w.Write([]byte(html))
+// providersForReferer filters providers down to those allowed by the proxy
+// serving the referer host, if it restricts them.
+func providersForReferer(providers map[string]OAuthProvider, referer string) map[string]OAuthProvider {
+	u, err := url.Parse("https://" + referer)
+	if err != nil || referer == "" {
+		return providers
+	}
+	pd, found := lookupProxy(u.Hostname())
+	if !found || len(pd.AllowedProviders) == 0 {
+		return providers
+	}
+
+	filtered := make(map[string]OAuthProvider)
+	for key, p := range providers {
+		if sliceContains(pd.AllowedProviders, key) {
+			filtered[key] = p
+		}
+	}
+	return filtered
 }
 
 func oauth2authhandler(w http.ResponseWriter, r *http.Request) {
@@ -554,6 +1185,7 @@ func oauth2authhandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	providerKey := parts[3]
+	spanFromContext(r.Context()).setAttr("pylon.provider", providerKey)
 
 	cfgMu.RLock()
 	prov, found := cfg.OAuthProviders[providerKey]
@@ -604,10 +1236,44 @@ func oauth2authhandler(w http.ResponseWriter, r *http.Request) {
 		Endpoint:     endpoint,
 	}
 
-	url := googleAuth.AuthCodeURL(state)
+	var opts []oauth2.AuthCodeOption
+	if maxAge := r.URL.Query().Get("max_age"); maxAge != "" {
+		opts = stepUpAuthOptions(prov.Type, maxAge)
+		// Lets the callback check the provider really re-authenticated
+		http.SetCookie(w, &http.Cookie{
+			Name:     "pylon_oauth_max_age",
+			Value:    maxAge,
+			Domain:   tldn,
+			Path:     "/",
+			MaxAge:   300,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	url := googleAuth.AuthCodeURL(state, opts...)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
+// stepUpAuthOptions asks OIDC providers to re-authenticate the user rather
+// than silently reusing an existing IdP session.
+func stepUpAuthOptions(provType string, maxAge string) []oauth2.AuthCodeOption {
+	switch provType {
+	case "github", "gitlab":
+		// Plain OAuth2 providers have no re-authentication parameters
+		return nil
+	case "google":
+		// Google rejects prompt=login, but honours max_age
+		return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("max_age", maxAge)}
+	default:
+		return []oauth2.AuthCodeOption{
+			oauth2.SetAuthURLParam("prompt", "login"),
+			oauth2.SetAuthURLParam("max_age", maxAge),
+		}
+	}
+}
+
 func getProviderEndpoint(provType string, customAuth, customToken string) oauth2.Endpoint {
 	switch provType {
 	case "google":
@@ -649,6 +1315,7 @@ func oauth2callbackhandler(w http.ResponseWriter, r *http.Request) {
 	cfgMu.RUnlock()
 
 	if !found {
+		emitAuthEvent(r, AuthEvent{Event: authEventCallbackError, Provider: providerKey, Reason: "provider not configured"})
 		http.Error(w, fmt.Sprintf("OAuth Provider %q not configured", providerKey), http.StatusBadRequest)
 		return
 	}
@@ -659,6 +1326,7 @@ func oauth2callbackhandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil || stateCookie.Value == "" || stateCookie.Value != stateParam {
 		http.Error(w, "CSRF State Verification Failed", http.StatusBadRequest)
 		log.Printf("OAuth callback state mismatch: param=%s, cookie=%v", stateParam, stateCookie)
+		emitAuthEvent(r, AuthEvent{Event: authEventCallbackError, Provider: providerKey, Reason: "state mismatch"})
 		return
 	}
 
@@ -668,6 +1336,14 @@ func oauth2callbackhandler(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		referer = refererCookie.Value
 	}
+	proxyHost := refererHost(referer)
+
+	var stepUpMaxAge time.Duration
+	if maxAgeCookie, err := r.Cookie("pylon_oauth_max_age"); err == nil {
+		if seconds, err := strconv.ParseInt(maxAgeCookie.Value, 10, 64); err == nil && seconds > 0 {
+			stepUpMaxAge = time.Duration(seconds) * time.Second
+		}
+	}
 
 	// Clear OAuth cookies
 	http.SetCookie(w, &http.Cookie{
@@ -686,6 +1362,14 @@ func oauth2callbackhandler(w http.ResponseWriter, r *http.Request) {
 		MaxAge:   -1,
 		HttpOnly: true,
 	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "pylon_oauth_max_age",
+		Value:    "",
+		Domain:   tldn,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
 
 	endpoint := getProviderEndpoint(prov.Type, prov.AuthURL, prov.TokenURL)
 	googleAuth := &oauth2.Config{
@@ -696,30 +1380,70 @@ func oauth2callbackhandler(w http.ResponseWriter, r *http.Request) {
 		Endpoint:     endpoint,
 	}
 
-	tkn, err := googleAuth.Exchange(context.TODO(), r.URL.Query().Get("code"))
+	spanFromContext(r.Context()).setAttr("pylon.provider", providerKey)
+	ctx, exchangeSpan := startSpan(r.Context(), "oauth token exchange", spanKindClient)
+	exchangeSpan.setAttr("server.address", endpoint.TokenURL)
+	tkn, err := googleAuth.Exchange(ctx, r.URL.Query().Get("code"))
+	exchangeSpan.setError(err)
+	exchangeSpan.end()
 	if err != nil {
 		log.Print("Error exchanging token:", err)
+		emitAuthEvent(r, AuthEvent{Event: authEventLoginFailure, Provider: providerKey, Proxy: proxyHost, Reason: "token exchange failed: " + err.Error()})
 		http.Error(w, "Failed to exchange authorization token", http.StatusInternalServerError)
 		return
 	}
 
 	if !tkn.Valid() {
 		log.Print("Invalid token received")
+		emitAuthEvent(r, AuthEvent{Event: authEventLoginFailure, Provider: providerKey, Proxy: proxyHost, Reason: "invalid token"})
 		http.Error(w, "Invalid Token", http.StatusBadRequest)
 		return
 	}
 
 	// Fetch user email based on provider rules
-	email, err := getEmailFromProvider(context.TODO(), prov.Type, tkn, prov.UserInfoURL)
+	email, err := getEmailFromProvider(r.Context(), prov.Type, tkn, prov.UserInfoURL)
 	if err != nil {
 		log.Print("Failed to retrieve email:", err)
+		emitAuthEvent(r, AuthEvent{Event: authEventLoginFailure, Provider: providerKey, Proxy: proxyHost, Reason: "no verified email: " + err.Error()})
 		http.Error(w, "Failed to retrieve verified email", http.StatusUnauthorized)
 		return
 	}
 
+	// A step-up login the provider answered from an existing session would
+	// send the user straight back here; say so instead of looping
+	authTime := authTimeFromToken(tkn)
+	if stepUpMaxAge > 0 && time.Since(authTime) > stepUpMaxAge+time.Minute {
+		log.Printf("Provider %s did not re-authenticate %s (authenticated %v ago)", providerKey, email, time.Since(authTime).Round(time.Second))
+		emitAuthEvent(r, AuthEvent{Event: authEventLoginFailure, User: email, Provider: providerKey, Proxy: proxyHost, Reason: "provider did not re-authenticate"})
+		writePylonPage(w, http.StatusUnauthorized, "Re-authentication required",
+			"This service requires a recent login, but the login provider did not ask you to sign in again. Sign out of the provider and try again.", "")
+		return
+	}
+
 	sessionStore := getSessionStore()
 	session, _ := sessionStore.Get(r, "pylon")
 	session.Values["email"] = email
+	session.Values["provider"] = providerKey
+	session.Values["auth_time"] = authTime.Unix()
+	delete(session.Values, "github_orgs")
+	delete(session.Values, "github_teams")
+	delete(session.Values, "github_groups_at")
+	dropGithubToken(email)
+
+	// Resolve GitHub org/team memberships for team based authorization
+	if prov.Type == "github" {
+		ctx, groupsSpan := startSpan(r.Context(), "github memberships", spanKindClient)
+		orgs, teams, err := getGithubGroups(ctx, tkn)
+		groupsSpan.setError(err)
+		groupsSpan.end()
+		if err != nil {
+			log.Printf("Failed to retrieve GitHub memberships for %s: %v", email, err)
+		} else {
+			setSessionGithubGroups(session, orgs, teams)
+			storeGithubToken(email, tkn)
+		}
+	}
+
 	session.Options = &sessions.Options{
 		Path:     "/",
 		Domain:   tldn,
@@ -729,9 +1453,11 @@ func oauth2callbackhandler(w http.ResponseWriter, r *http.Request) {
 	}
 	err = session.Save(r, w)
 	if err != nil {
+		emitAuthEvent(r, AuthEvent{Event: authEventLoginFailure, User: email, Provider: providerKey, Proxy: proxyHost, Reason: "session not saved: " + err.Error()})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	emitAuthEvent(r, AuthEvent{Event: authEventLogin, User: email, Provider: providerKey, Proxy: proxyHost})
 
 	if referer == "" {
 		fmt.Fprintf(w, "Authenticated as %s", email)
@@ -741,13 +1467,21 @@ func oauth2callbackhandler(w http.ResponseWriter, r *http.Request) {
 	if !isValidRedirect(referer, tldn) {
 		http.Error(w, "Forbidden Redirect Target", http.StatusForbidden)
 		log.Printf("Blocked open redirect attempt to: %s", referer)
+		emitAuthEvent(r, AuthEvent{Event: authEventCallbackError, User: email, Provider: providerKey, Proxy: proxyHost, Reason: "redirect target not allowed"})
 		return
 	}
 
 	http.Redirect(w, r, "https://"+referer, http.StatusFound)
 }
 
-func getEmailFromProvider(ctx context.Context, provType string, token *oauth2.Token, userInfoURL string) (string, error) {
+func getEmailFromProvider(ctx context.Context, provType string, token *oauth2.Token, userInfoURL string) (email string, err error) {
+	ctx, span := startSpan(ctx, "oauth userinfo", spanKindClient)
+	span.setAttr("pylon.provider_type", provType)
+	defer func() {
+		span.setError(err)
+		span.end()
+	}()
+
 	switch provType {
 	case "google":
 		idToken, ok := token.Extra("id_token").(string)
@@ -889,6 +1623,212 @@ func getEmailFromProvider(ctx context.Context, provType string, token *oauth2.To
 	}
 }
 
+// getGithubGroups returns the organization logins and "org/team-slug" pairs the
+// token's user belongs to. Requires the read:org scope (or the members
+// permission for GitHub Apps).
+func getGithubGroups(ctx context.Context, token *oauth2.Token) ([]string, []string, error) {
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err := getGithubPaginated(ctx, token, "https://api.github.com/user/orgs", &orgs); err != nil {
+		return nil, nil, err
+	}
+	var teams []struct {
+		Slug         string `json:"slug"`
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	if err := getGithubPaginated(ctx, token, "https://api.github.com/user/teams", &teams); err != nil {
+		return nil, nil, err
+	}
+
+	orgNames := make([]string, 0, len(orgs))
+	for _, o := range orgs {
+		orgNames = append(orgNames, o.Login)
+	}
+	teamNames := make([]string, 0, len(teams))
+	for _, t := range teams {
+		teamNames = append(teamNames, t.Organization.Login+"/"+t.Slug)
+	}
+	return orgNames, teamNames, nil
+}
+
+// errGithubTokenRejected is returned when GitHub no longer accepts a token,
+// e.g. because the user revoked it.
+var errGithubTokenRejected = errors.New("github rejected the token")
+
+// getGithubPaginated decodes every page of a GitHub list endpoint into out,
+// which must be a pointer to a slice.
+func getGithubPaginated(ctx context.Context, token *oauth2.Token, endpoint string, out interface{}) error {
+	var all []json.RawMessage
+	for page := 1; ; page++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s?per_page=100&page=%d", endpoint, page), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		var items []json.RawMessage
+		if resp.StatusCode == http.StatusUnauthorized {
+			resp.Body.Close()
+			return errGithubTokenRejected
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("github api %s returned status %d", endpoint, resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&items)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		all = append(all, items...)
+		if len(items) < 100 {
+			break
+		}
+	}
+
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// githubGroupsOf collects the lower cased orgs and teams allowed by the
+// proxies and their routes.
+func githubGroupsOf(proxies map[string]*ProxyDetails) map[string]bool {
+	groups := make(map[string]bool)
+	add := func(pd *ProxyDetails) {
+		for _, org := range pd.AllowedGithubOrgs {
+			groups[strings.ToLower(org)] = true
+		}
+		for _, team := range pd.AllowedGithubTeams {
+			groups[strings.ToLower(team)] = true
+		}
+	}
+	for _, pd := range proxies {
+		add(pd)
+		for _, rt := range pd.Routes {
+			add(rt.details)
+		}
+	}
+	return groups
+}
+
+// githubGroupsInUseOf keeps the memberships some proxy or route refers to.
+// Members of many orgs and teams would otherwise outgrow the session cookie.
+func githubGroupsInUseOf(groups []string) []string {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	kept := []string{}
+	for _, group := range groups {
+		if githubGroupsInUse[strings.ToLower(group)] {
+			kept = append(kept, group)
+		}
+	}
+	return kept
+}
+
+func setSessionGithubGroups(session *sessions.Session, orgs, teams []string) {
+	session.Values["github_orgs"] = githubGroupsInUseOf(orgs)
+	session.Values["github_teams"] = githubGroupsInUseOf(teams)
+	session.Values["github_groups_at"] = time.Now().Unix()
+}
+
+// storeGithubToken keeps the user's GitHub token for refreshing their
+// memberships, dropping the tokens that are past their lifetime.
+func storeGithubToken(email string, tkn *oauth2.Token) {
+	githubTokensMu.Lock()
+	defer githubTokensMu.Unlock()
+	now := time.Now()
+	for e, t := range githubTokens {
+		if now.Sub(t.storedAt) > githubTokenLifetime {
+			delete(githubTokens, e)
+		}
+	}
+	githubTokens[email] = githubToken{token: tkn, storedAt: now}
+}
+
+// loadGithubToken returns the user's stored GitHub token, or nil if there is
+// none or it is past its lifetime.
+func loadGithubToken(email string) *oauth2.Token {
+	githubTokensMu.Lock()
+	defer githubTokensMu.Unlock()
+	t, found := githubTokens[email]
+	if !found {
+		return nil
+	}
+	if time.Since(t.storedAt) > githubTokenLifetime {
+		delete(githubTokens, email)
+		return nil
+	}
+	return t.token
+}
+
+func dropGithubToken(email string) {
+	githubTokensMu.Lock()
+	delete(githubTokens, email)
+	githubTokensMu.Unlock()
+}
+
+// sessionIdentity reads the authenticated user from the session, re-fetching
+// GitHub memberships once they are older than the configured refresh interval.
+func sessionIdentity(w http.ResponseWriter, r *http.Request, session *sessions.Session) authIdentity {
+	id := authIdentity{}
+	id.Email, _ = session.Values["email"].(string)
+	id.Provider, _ = session.Values["provider"].(string)
+	if authTime, ok := session.Values["auth_time"].(int64); ok {
+		id.AuthTime = time.Unix(authTime, 0)
+	}
+	id.GithubOrgs, _ = session.Values["github_orgs"].([]string)
+	id.GithubTeams, _ = session.Values["github_teams"].([]string)
+
+	fetchedAt, ok := session.Values["github_groups_at"].(int64)
+	if !ok {
+		return id
+	}
+
+	cfgMu.RLock()
+	refresh := time.Duration(cfg.GithubGroupsRefresh)
+	cfgMu.RUnlock()
+	if refresh <= 0 {
+		refresh = 15 * time.Minute
+	}
+	if time.Since(time.Unix(fetchedAt, 0)) < refresh {
+		return id
+	}
+
+	tkn := loadGithubToken(id.Email)
+	if tkn == nil {
+		id.GithubStale = true
+		return id
+	}
+
+	orgs, teams, err := getGithubGroups(r.Context(), tkn)
+	if err != nil {
+		log.Printf("Failed to refresh GitHub memberships for %s: %v", id.Email, err)
+		if err == errGithubTokenRejected {
+			dropGithubToken(id.Email)
+		}
+		id.GithubStale = true
+		return id
+	}
+	setSessionGithubGroups(session, orgs, teams)
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to save refreshed GitHub memberships for %s: %v", id.Email, err)
+	}
+	id.GithubOrgs, _ = session.Values["github_orgs"].([]string)
+	id.GithubTeams, _ = session.Values["github_teams"].([]string)
+	return id
+}
+
 func (pd *ProxyDetails) proxy(w http.ResponseWriter, r *http.Request) {
 	sessionStore := getSessionStore()
 	session, _ := sessionStore.Get(r, "pylon")
@@ -920,34 +1860,119 @@ func (pd *ProxyDetails) proxy(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			AppListHandler(w, r, emailVal.(string))
+			AppListHandler(w, r, sessionIdentity(w, r, session))
 		}
 		return
 	}
 
+	// Paths routed elsewhere within this host
+	pd = pd.route(r.URL.Path)
+
+	ip := clientIP(r)
+	if !pd.IPRules.permits(ip) {
+		log.Printf("client %s denied by ip rules for target host: %s", ip, r.Host)
+		emitAuthEvent(r, AuthEvent{Event: authEventDeny, Address: ip.String(), Reason: "ip rules"})
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Trusted networks skip OAuth entirely
+	bypass := ""
+	if pd.IPRules.trusts(ip) || globalIPRulesTrust(ip) {
+		bypass = "trusted network"
+	} else if pd.Public {
+		bypass = "public route"
+	} else if pd.isUnauthenticatedRoute(r.URL.Path) {
+		bypass = "unauthenticated route"
+	}
+
 	// Authenticate and Authorize
-	if !pd.isUnauthenticatedRoute(r.URL.Path) {
-		if emailVal == nil {
-			referer := fmt.Sprintf("%s%s", r.Host, r.URL.Path)
-			// Redirect to the unified login gateway
-			http.Redirect(w, r, fmt.Sprintf("/pylon/login?referer=%s", referer), http.StatusFound)
+	var id authIdentity
+	if bypass != "" {
+		emitAuthEvent(r, AuthEvent{Event: authEventBypass, Address: ip.String(), Reason: bypass})
+	} else {
+		if token := bearerToken(r); token != "" {
+			// CLI and script access with a Pylon-issued token
+			var ok bool
+			id, ok = tokenIdentity(token, pd.External)
+			if !ok {
+				emitAuthEvent(r, AuthEvent{Event: authEventDeny, Address: ip.String(), Reason: "invalid token"})
+				w.Header().Set("WWW-Authenticate", `Bearer realm="Pylon", error="invalid_token"`)
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			// Pylon tokens are never forwarded upstream
+			r.Header.Del("Authorization")
+		} else {
+			if emailVal == nil {
+				emitAuthEvent(r, AuthEvent{Event: authEventDeny, Address: ip.String(), Reason: "not logged in"})
+				redirectToLogin(w, r)
+				return
+			}
+			id = sessionIdentity(w, r, session)
+		}
+		denied := AuthEvent{Event: authEventDeny, User: id.Email, Provider: id.Provider, TokenID: id.TokenID, Address: ip.String()}
+
+		email := id.Email
+		if !pd.acceptsProvider(id.Provider) {
+			// Logged in through a provider this proxy doesn't accept
+			log.Printf("user %s authenticated with provider %q not allowed for target host: %s", email, id.Provider, r.Host)
+			denied.Reason = "provider not allowed"
+			emitAuthEvent(r, denied)
+			reauthenticate(w, r, id, 0)
+			return
+		}
+
+		if pd.MaxAuthAge > 0 && time.Since(id.AuthTime) > pd.MaxAuthAge {
+			// Step-up: sensitive proxy requires a recent login
+			log.Printf("user %s authentication too old for target host: %s", email, r.Host)
+			denied.Reason = "authentication too old"
+			emitAuthEvent(r, denied)
+			reauthenticate(w, r, id, pd.MaxAuthAge)
+			return
+		}
+
+		if id.GithubStale && pd.usesGithubGroups() && !pd.userInAllowedList(email) {
+			// Memberships can't be verified anymore; log in again to refresh them
+			denied.Reason = "github memberships stale"
+			emitAuthEvent(r, denied)
+			reauthenticate(w, r, id, 0)
 			return
 		}
 
-		email := emailVal.(string)
-		if !pd.userInAllowedList(email) {
-			w.Header().Set("Content-Type", "text/html")
-			fmt.Fprintf(w, `<h3>User %s is unauthorized to access this resource.</h3>
-							<button onclick="window.location.href = '/pylon/login';">Login</button>`, email)
+		if !pd.authorizes(id) {
 			log.Printf("user %s not allowed for target host: %s", email, r.Host)
+			denied.Reason = "not allowed"
+			emitAuthEvent(r, denied)
+			if id.TokenID != "" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			writeUnauthorizedPage(w, r, pd, id)
 			return
 		}
+		emitAuthEvent(r, AuthEvent{Event: authEventAllow, User: id.Email, Provider: id.Provider, TokenID: id.TokenID, Address: ip.String()})
 	}
 
-	// Forward request via the pre-instantiated ReverseProxy
-	remoteAddr := strings.Split(r.RemoteAddr, ":")[0]
+	// Rate limit per user once known, otherwise per client address
+	info := requestInfoFrom(r)
+	info.User = id.Email
+	if email, ok := emailVal.(string); ok && info.User == "" {
+		info.User = email
+	}
+	limitKey := "ip:" + ip.String()
+	if info.User != "" {
+		limitKey = "user:" + info.User
+		markUserActive(info.User)
+	}
+	globalLimiter, _ := getGlobalRateLimiters()
+	if !checkRateLimits(w, limitKey, globalLimiter, pd.RateLimiter) {
+		return
+	}
 
-    r.Header.Set("X-Forwarded-Host", r.Host)
+	// Forward request to one of the proxy's targets
+
+	r.Header.Set("X-Forwarded-Host", r.Host)
 	if r.TLS != nil {
 		r.Header.Set("X-Forwarded-Ssl", "on")
 		r.Header.Set("X-Forwarded-Proto", "https")
@@ -957,9 +1982,68 @@ func (pd *ProxyDetails) proxy(w http.ResponseWriter, r *http.Request) {
 		r.Header.Set("X-Forwarded-Port", "80")
 	}
 
-	r.Header.Set("X-Forwarded-For", remoteAddr)
+	r.Header.Set("X-Forwarded-For", ip.String())
 
-	pd.ReverseProxy.ServeHTTP(w, r)
+	if location, status := pd.rewrite(r); location != "" {
+		http.Redirect(w, r, location, status)
+		return
+	}
+	if pd.Static != nil {
+		pd.stripPrefix(r)
+		pd.Static.ServeHTTP(w, r)
+		return
+	}
+	// Before the header rules, which may change the Host the captures of a
+	// wildcard proxy come from
+	upstreams, err := pd.Upstreams.forHost(hostCaptures(r.Host))
+	if err != nil {
+		log.Printf("no upstream for %s: %v", r.Host, err)
+		writeServiceDownPage(w, r, http.StatusBadGateway)
+		return
+	}
+	pd.Headers.applyRequest(r)
+	if upstreams.down() {
+		writeServiceDownPage(w, r, http.StatusServiceUnavailable)
+		return
+	}
+	pd.stripPrefix(r)
+	target := upstreams.pick(r)
+	info.Upstream = target.URL
+	ctx, span := startSpan(r.Context(), "proxy upstream", spanKindClient)
+	span.setAttr("server.address", target.URL)
+	span.inject(r.Header)
+	upstreams.serve(w, r.WithContext(ctx), target)
+	span.end()
+}
+
+// redirectToLogin sends the user to the unified login gateway, returning to the
+// current host and path afterwards.
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	referer := fmt.Sprintf("%s%s", r.Host, r.URL.Path)
+	http.Redirect(w, r, fmt.Sprintf("/pylon/login?referer=%s", referer), http.StatusFound)
+}
+
+// reauthenticate asks the client to log in again, requiring a fresh provider
+// login when maxAge is set. Bearer token clients can't follow the login flow
+// and get a 401 instead.
+func reauthenticate(w http.ResponseWriter, r *http.Request, id authIdentity, maxAge time.Duration) {
+	if id.TokenID != "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Pylon", error="invalid_token"`)
+		http.Error(w, "Token not accepted for this resource", http.StatusUnauthorized)
+		return
+	}
+	if maxAge > 0 {
+		redirectToStepUp(w, r, maxAge)
+		return
+	}
+	redirectToLogin(w, r)
+}
+
+// redirectToStepUp is redirectToLogin, additionally requiring the provider to
+// re-authenticate the user.
+func redirectToStepUp(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
+	referer := fmt.Sprintf("%s%s", r.Host, r.URL.Path)
+	http.Redirect(w, r, fmt.Sprintf("/pylon/login?referer=%s&max_age=%d", referer, int64(maxAge.Seconds())), http.StatusFound)
 }
 
 func enableCORS(w *http.ResponseWriter, r *http.Request) {
@@ -970,32 +2054,56 @@ func enableCORS(w *http.ResponseWriter, r *http.Request) {
 }
 
 func ConfigHandler(w http.ResponseWriter, r *http.Request) {
-	enableCORS(&w, r)
+	enableAdminCORS(&w, r)
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
+	admin := adminFromRequest(r)
+
 	if r.Method == "GET" {
 		cfgMu.RLock()
-		onboarded := cfg.AdminPasswordHash != "" && len(cfg.OAuthProviders) > 0
-		
+		conf := cfg
+		cfgMu.RUnlock()
+		onboarded := (conf.AdminPasswordHash != "" || len(conf.Admins) > 0) && len(conf.OAuthProviders) > 0
+
+		// Only owners get to see secrets
+		if admin.Role != adminRoleOwner {
+			conf = redactConfig(conf)
+		}
+
 		// Return config along with onboarded virtual status field
 		respMap := map[string]interface{}{
-			"tldn":                 cfg.TLDN,
-			"allowed_users":        cfg.AllowedUsers,
-			"admin_password_hash":  cfg.AdminPasswordHash,
-			"insecure_skip_verify": cfg.InsecureSkipVerify,
-			"proxies":              cfg.Proxies,
-			"session_key":          cfg.SessionKey,
-			"cookie_expire":        cfg.CookieExpire,
-			"oauth_providers":      cfg.OAuthProviders,
-			"onboarded":            onboarded,
+			"tldn":                      conf.TLDN,
+			"allowed_users":             conf.AllowedUsers,
+			"admin_password_hash":       conf.AdminPasswordHash,
+			"insecure_skip_verify":      conf.InsecureSkipVerify,
+			"proxies":                   conf.Proxies,
+			"session_key":               conf.SessionKey,
+			"cookie_expire":             conf.CookieExpire,
+			"oauth_providers":           conf.OAuthProviders,
+			"github_groups_refresh":     conf.GithubGroupsRefresh,
+			"device_token_ttl":          conf.DeviceTokenTTL,
+			"admin_notify_webhook":      conf.AdminNotifyWebhook,
+			"ip_rules":                  conf.IPRules,
+			"trusted_proxies":           conf.TrustedProxies,
+			"rate_limit":                conf.RateLimit,
+			"auth_rate_limit":           conf.AuthRateLimit,
+			"admins":                    conf.Admins,
+			"admin_basic_auth_fallback": conf.AdminBasicAuthFallback,
+			"admin_url":                 conf.AdminURL,
+			"onboarded":                 onboarded,
+			// Who is looking, so the panel can adapt to the role
+			"current_admin": map[string]interface{}{
+				"email":   admin.Email,
+				"role":    admin.Role,
+				"proxies": admin.Proxies,
+			},
 		}
 		payload, err := json.MarshalIndent(respMap, "", "    ")
-		cfgMu.RUnlock()
-		
+
 		if err != nil {
 			log.Printf("Error marshalling config: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -1016,16 +2124,23 @@ func ConfigHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		cfgMu.RLock()
-		currentHash := cfg.AdminPasswordHash
-		cfgMu.RUnlock()
+		configWriteMu.Lock()
+		defer configWriteMu.Unlock()
+
+		current := copyConfig()
+		if err := authorizeConfigChange(admin, current, &new_config); err != nil {
+			log.Printf("Config change by %s rejected: %v", admin.Email, err)
+			http.Error(w, fmt.Sprintf("Forbidden: %v", err), http.StatusForbidden)
+			return
+		}
+		currentHash := current.AdminPasswordHash
 
 		// Hash password if plain-text was sent, otherwise preserve existing
 		if new_config.AdminPasswordHash != "" {
 			isBcrypt := strings.HasPrefix(new_config.AdminPasswordHash, "$2a$") ||
 				strings.HasPrefix(new_config.AdminPasswordHash, "$2b$") ||
 				strings.HasPrefix(new_config.AdminPasswordHash, "$2y$")
-			
+
 			if !isBcrypt {
 				hash, err := bcrypt.GenerateFromPassword([]byte(new_config.AdminPasswordHash), bcrypt.DefaultCost)
 				if err != nil {
@@ -1039,24 +2154,8 @@ func ConfigHandler(w http.ResponseWriter, r *http.Request) {
 			new_config.AdminPasswordHash = currentHash
 		}
 
-		pretty, err := json.MarshalIndent(new_config, "", "    ")
-		if err != nil {
-			log.Print("Error encoding configuration:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		configPath := getConfigPath()
-		err = os.WriteFile(configPath, pretty, 0600)
-		if err != nil {
-			log.Print("Error writing to config file:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		// Reload configuration dynamically
-		if err := loadConfig(); err != nil {
-			log.Print("Failed to reload newly written config:", err)
+		if err := saveConfig(new_config, adminActor(r, "")); err != nil {
+			log.Print("Error saving config:", err)
 			http.Error(w, "Failed to apply configuration internally", http.StatusInternalServerError)
 			return
 		}
@@ -1067,7 +2166,110 @@ func ConfigHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func AppListHandler(w http.ResponseWriter, r *http.Request, user string) {
+// configWriteMu serialises config changes from copyConfig through the
+// reload, so changes made at the same time can't undo each other.
+var configWriteMu sync.Mutex
+
+// errConfigUnchanged is returned by an updateConfig change with nothing to
+// save.
+var errConfigUnchanged = errors.New("configuration unchanged")
+
+// updateConfig applies change to a copy of the current config and saves it.
+func updateConfig(actor configActor, change func(conf *Config) error) error {
+	configWriteMu.Lock()
+	defer configWriteMu.Unlock()
+
+	conf := copyConfig()
+	if err := change(&conf); err == errConfigUnchanged {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return saveConfig(conf, actor)
+}
+
+// saveConfig writes the config to disk and reloads it. Everything that
+// changes the config goes through here, so it is recorded in the audit log.
+// Callers hold configWriteMu.
+func saveConfig(conf Config, actor configActor) error {
+	file, err := readConfigFile()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+	removeEnvOverrides(&conf, file)
+
+	pretty, err := json.MarshalIndent(conf, "", "    ")
+	if err != nil {
+		return fmt.Errorf("encoding configuration: %v", err)
+	}
+
+	err = os.WriteFile(getConfigPath(), pretty, 0600)
+	if err != nil {
+		return fmt.Errorf("writing config file: %v", err)
+	}
+
+	// Reload configuration dynamically
+	if err := loadConfig(); err != nil {
+		return fmt.Errorf("reloading newly written config: %v", err)
+	}
+
+	// File to file, so environment overrides don't show up as changes
+	if err := appendConfigAudit(actor, file, conf); err != nil {
+		log.Printf("Failed to write config audit log: %v", err)
+	}
+	return nil
+}
+
+// pruneExpiredGrants periodically removes expired time-bound allowed users
+// from the config. They are already ignored by userInAllowedList once expired;
+// this keeps config.json and the admin panel tidy.
+func pruneExpiredGrants() {
+	for range time.Tick(time.Minute) {
+		err := updateConfig(configActor{Name: "pylon", Reason: "expired grants pruned"}, func(conf *Config) error {
+			now := time.Now()
+			pruned := false
+			for i := range conf.Proxies {
+				kept := conf.Proxies[i].AllowedUsers[:0]
+				for _, u := range conf.Proxies[i].AllowedUsers {
+					if u.expiredAt(now) {
+						log.Printf("Access of %s to %s expired", u.Email, conf.Proxies[i].External)
+						pruned = true
+						continue
+					}
+					kept = append(kept, u)
+				}
+				conf.Proxies[i].AllowedUsers = kept
+			}
+			if !pruned {
+				return errConfigUnchanged
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to prune expired grants: %v", err)
+		}
+	}
+}
+
+// copyConfig returns a copy of the current config whose proxies can be
+// modified without affecting the live config.
+func copyConfig() Config {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+
+	conf := cfg
+	conf.Proxies = append(conf.Proxies[:0:0], cfg.Proxies...)
+	for i := range conf.Proxies {
+		conf.Proxies[i].AllowedUsers = append([]AllowedUser(nil), cfg.Proxies[i].AllowedUsers...)
+	}
+	conf.OAuthProviders = make(map[string]OAuthProvider)
+	for key, p := range cfg.OAuthProviders {
+		conf.OAuthProviders[key] = p
+	}
+	return conf
+}
+
+func AppListHandler(w http.ResponseWriter, r *http.Request, id authIdentity) {
 	enableCORS(&w, r)
 
 	if r.Method == "OPTIONS" {
@@ -1083,8 +2285,20 @@ func AppListHandler(w http.ResponseWriter, r *http.Request, user string) {
 		allowedApps := new(AppListResponse)
 
 		for _, proxy := range proxiesList {
-			if sliceContains(proxy.AllowedUsers, user) {
+			// Wildcard proxies have no single host to link to, and
+			// redirects are no apps
+			if isWildcardHost(proxy.External) || proxy.Redirect != nil {
+				continue
+			}
+			pd, found := lookupProxyByName(proxy.External)
+			if found && pd.authorizes(id) {
 				allowedApps.Apps = append(allowedApps.Apps, proxy.External)
+				if health, checked := healthOf(proxy.External); checked {
+					if allowedApps.Health == nil {
+						allowedApps.Health = make(map[string]AppHealth)
+					}
+					allowedApps.Health[proxy.External] = AppHealth{Status: health.Status}
+				}
 			}
 		}
 
@@ -1109,6 +2323,17 @@ func sliceContains(s []string, str string) bool {
 	return false
 }
 
+// sliceContainsFold is sliceContains for case-insensitive names such as GitHub
+// logins.
+func sliceContainsFold(s []string, str string) bool {
+	for _, v := range s {
+		if strings.EqualFold(v, str) {
+			return true
+		}
+	}
+	return false
+}
+
 func getSubdomain(r *http.Request) string {
 	host := r.Host
 	host = strings.TrimSpace(host)
@@ -1154,23 +2379,48 @@ func isValidRedirect(referer string, tldn string) bool {
 	return isAllowedDomain(host)
 }
 
-func emailFromIdToken(idToken string) (string, error) {
+// idTokenClaims decodes the payload of an id_token into v. The token comes
+// straight from the provider's token endpoint, so its signature isn't checked.
+func idTokenClaims(idToken string, v interface{}) error {
 	jwt := strings.Split(idToken, ".")
 	if len(jwt) < 2 {
-		return "", errors.New("invalid jwt format")
+		return errors.New("invalid jwt format")
 	}
 	jwtData := strings.TrimSuffix(jwt[1], "=")
 	b, err := base64.RawURLEncoding.DecodeString(jwtData)
 	if err != nil {
-		return "", err
+		return err
 	}
+	return json.Unmarshal(b, v)
+}
 
+// authTimeFromToken is when the provider last authenticated the user, from
+// the id_token's auth_time claim. Providers without one, such as GitHub and
+// GitLab, are taken to have just authenticated the user.
+func authTimeFromToken(tkn *oauth2.Token) time.Time {
+	now := time.Now()
+	idToken, _ := tkn.Extra("id_token").(string)
+	if idToken == "" {
+		return now
+	}
+	var claims struct {
+		AuthTime int64 `json:"auth_time"`
+	}
+	if err := idTokenClaims(idToken, &claims); err != nil || claims.AuthTime <= 0 {
+		return now
+	}
+	if authTime := time.Unix(claims.AuthTime, 0); authTime.Before(now) {
+		return authTime
+	}
+	return now
+}
+
+func emailFromIdToken(idToken string) (string, error) {
 	var email struct {
 		Email         string `json:"email"`
 		EmailVerified bool   `json:"email_verified"`
 	}
-	err = json.Unmarshal(b, &email)
-	if err != nil {
+	if err := idTokenClaims(idToken, &email); err != nil {
 		return "", err
 	}
 	if email.Email == "" {
@@ -1183,14 +2433,44 @@ func emailFromIdToken(idToken string) (string, error) {
 }
 
 func (pd *ProxyDetails) userInAllowedList(email string) bool {
+	now := time.Now()
 	for _, b := range pd.AllowedUsers {
-		if b == email {
+		if b.Email == email && b.activeAt(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizes reports whether the user is allowed by email or by one of their
+// GitHub org/team memberships.
+func (pd *ProxyDetails) authorizes(id authIdentity) bool {
+	if pd.userInAllowedList(id.Email) {
+		return true
+	}
+	for _, org := range id.GithubOrgs {
+		if sliceContainsFold(pd.AllowedGithubOrgs, org) {
+			return true
+		}
+	}
+	for _, team := range id.GithubTeams {
+		if sliceContainsFold(pd.AllowedGithubTeams, team) {
 			return true
 		}
 	}
 	return false
 }
 
+// acceptsProvider reports whether sessions from the given provider key may
+// access this proxy.
+func (pd *ProxyDetails) acceptsProvider(provider string) bool {
+	return len(pd.AllowedProviders) == 0 || sliceContains(pd.AllowedProviders, provider)
+}
+
+func (pd *ProxyDetails) usesGithubGroups() bool {
+	return len(pd.AllowedGithubOrgs) > 0 || len(pd.AllowedGithubTeams) > 0
+}
+
 func (pd *ProxyDetails) isUnauthenticatedRoute(path string) bool {
 	if len(pd.UnauthenticatedRoutesRegex.String()) > 0 && pd.UnauthenticatedRoutesRegex.MatchString(path) {
 		log.Printf("Bypass Pylon due to regex match: %v for path: %s for internal host: %s", pd.UnauthenticatedRoutesRegex.String(), path, pd.Internal)
@@ -1241,36 +2521,24 @@ func githubRegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add to config
-	cfgMu.Lock()
-	tldn := cfg.TLDN
-	// If oauth_providers doesn't exist, make it
-	if cfg.OAuthProviders == nil {
-		cfg.OAuthProviders = make(map[string]OAuthProvider)
-	}
-	cfg.OAuthProviders["github"] = OAuthProvider{
-		ID:           "github",
-		Name:         "GitHub App",
-		Type:         "github",
-		ClientID:     appDetails.ClientID,
-		ClientSecret: appDetails.ClientSecret,
-		RedirectURL:  fmt.Sprintf("https://%s/pylon/callback/github", tldn),
-		Scopes:       []string{"read:user", "user:email"},
-	}
-	cfgCopy := cfg
-	cfgMu.Unlock()
-
-	// Write config to disk
-	pretty, err := json.MarshalIndent(cfgCopy, "", "    ")
-	if err == nil {
-		_ = os.WriteFile(getConfigPath(), pretty, 0600)
+	// Write config to disk and reload it in memory
+	actor := configActor{Name: "github-app-registration", Address: clientIP(r).String(), Reason: "GitHub App " + appDetails.Name + " registered"}
+	err = updateConfig(actor, func(conf *Config) error {
+		conf.OAuthProviders["github"] = OAuthProvider{
+			ID:           "github",
+			Name:         "GitHub App",
+			Type:         "github",
+			ClientID:     appDetails.ClientID,
+			ClientSecret: appDetails.ClientSecret,
+			RedirectURL:  fmt.Sprintf("https://%s/pylon/callback/github", conf.TLDN),
+			Scopes:       []string{"read:user", "user:email", "read:org"},
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print("Error saving GitHub App config:", err)
 	}
 
-	// Reload config in memory
-	_ = loadConfig()
-
 	// Redirect back to admin console
-	http.Redirect(w, r, "http://"+tldn+":3001/#/", http.StatusFound)
+	http.Redirect(w, r, getAdminURL()+"/#/", http.StatusFound)
 }
-
-
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAllowedUserWindow(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		user    AllowedUser
+		active  bool
+		expired bool
+	}{
+		{"permanent", AllowedUser{Email: "bob@example.com"}, true, false},
+		{"not yet started", AllowedUser{NotBefore: &after}, false, false},
+		{"started", AllowedUser{NotBefore: &before}, true, false},
+		{"running", AllowedUser{NotBefore: &before, Expires: &after}, true, false},
+		{"expired", AllowedUser{Expires: &before}, false, true},
+		{"expires now", AllowedUser{Expires: &now}, false, true},
+		{"starts now", AllowedUser{NotBefore: &now}, true, false},
+	}
+	for _, tt := range tests {
+		if got := tt.user.activeAt(now); got != tt.active {
+			t.Errorf("%s: activeAt = %v, want %v", tt.name, got, tt.active)
+		}
+		if got := tt.user.expiredAt(now); got != tt.expired {
+			t.Errorf("%s: expiredAt = %v, want %v", tt.name, got, tt.expired)
+		}
+	}
+}
+
+func TestAllowedUserJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		email   string
+		expires bool
+	}{
+		{`"bob@example.com"`, "bob@example.com", false},
+		{`{"email": "bob@example.com"}`, "bob@example.com", false},
+		{`{"email": "bob@example.com", "expires": "2026-01-02T15:04:05Z"}`, "bob@example.com", true},
+	}
+	for _, tt := range tests {
+		var u AllowedUser
+		if err := json.Unmarshal([]byte(tt.json), &u); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if u.Email != tt.email || (u.Expires != nil) != tt.expires {
+			t.Errorf("%s: got %+v", tt.json, u)
+		}
+
+		// Permanent grants are written back as plain emails
+		b, _ := json.Marshal(u)
+		if !tt.expires && string(b) != `"`+tt.email+`"` {
+			t.Errorf("%s: marshalled as %s", tt.json, b)
+		}
+	}
+}
+
+func TestGithubGroupsInUse(t *testing.T) {
+	proxies := map[string]*ProxyDetails{
+		"ci.example.com": {
+			AllowedGithubOrgs:  []string{"My-Org"},
+			AllowedGithubTeams: []string{"other-org/Platform"},
+		},
+		"wiki.example.com": {
+			Routes: []*proxyRoute{{prefix: "/admin", details: &ProxyDetails{AllowedGithubTeams: []string{"my-org/admins"}}}},
+		},
+	}
+	cfgMu.Lock()
+	saved := githubGroupsInUse
+	githubGroupsInUse = githubGroupsOf(proxies)
+	cfgMu.Unlock()
+	defer func() {
+		cfgMu.Lock()
+		githubGroupsInUse = saved
+		cfgMu.Unlock()
+	}()
+
+	tests := []struct {
+		groups []string
+		want   []string
+	}{
+		{nil, []string{}},
+		{[]string{"my-org", "unrelated", "another"}, []string{"my-org"}},
+		{[]string{"my-org/admins", "other-org/platform", "my-org/everyone"}, []string{"my-org/admins", "other-org/platform"}},
+		{[]string{"other-org"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := githubGroupsInUseOf(tt.groups); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestGithubTokenLifetime(t *testing.T) {
+	tkn := &oauth2.Token{AccessToken: "gho_test"}
+	storeGithubToken("fresh@example.com", tkn)
+	storeGithubToken("old@example.com", tkn)
+	githubTokensMu.Lock()
+	githubTokens["old@example.com"] = githubToken{token: tkn, storedAt: time.Now().Add(-githubTokenLifetime - time.Minute)}
+	githubTokensMu.Unlock()
+
+	if loadGithubToken("fresh@example.com") != tkn {
+		t.Error("fresh token not returned")
+	}
+	if loadGithubToken("old@example.com") != nil {
+		t.Error("expired token returned")
+	}
+	dropGithubToken("fresh@example.com")
+	if loadGithubToken("fresh@example.com") != nil {
+		t.Error("dropped token returned")
+	}
+	githubTokensMu.Lock()
+	defer githubTokensMu.Unlock()
+	if len(githubTokens) != 0 {
+		t.Errorf("%d tokens left", len(githubTokens))
+	}
+}
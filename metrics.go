@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics in the text exposition format, served on /metrics.
+
+const certCacheDir = "/certs"
+
+// How long after their last request users still count as active
+const activeSessionWindow = 5 * time.Minute
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricVec is a counter or gauge with labels.
+type metricVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+	values map[string]float64 // by joined label values
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.values[strings.Join(labelValues, "\xff")] += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metricVec) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.values[strings.Join(labelValues, "\xff")] = v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, key, ""), strconv.FormatFloat(m.values[key], 'g', -1, 64))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	hist, found := h.values[key]
+	if !found {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, fmt.Sprint(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+// formatLabels renders {name="value",...}, adding le for histogram buckets.
+func formatLabels(names []string, key string, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], value))
+			}
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	requestsTotal = newMetricVec("counter", "pylon_requests_total",
+		"Requests handled, by proxy host and status code.", "proxy", "code")
+	requestDuration = newHistogramVec("pylon_request_duration_seconds",
+		"Time taken to handle requests, by proxy host.", latencyBuckets, "proxy")
+	upstreamErrors = newMetricVec("counter", "pylon_upstream_errors_total",
+		"Requests that could not be proxied to the upstream, by proxy host.", "proxy")
+	websocketConnections = newMetricVec("gauge", "pylon_websocket_connections",
+		"Open upgraded (WebSocket) connections, by proxy host.", "proxy")
+	loginsTotal = newMetricVec("counter", "pylon_logins_total",
+		"OAuth logins, by provider and result.", "provider", "result")
+	configReloads = newMetricVec("counter", "pylon_config_reloads_total",
+		"Config loads, by result.", "result")
+	configLastReload = newMetricVec("gauge", "pylon_config_last_reload_success_timestamp_seconds",
+		"Time of the last successful config load.")
+
+	activeUsersMu sync.Mutex
+	activeUsers   = make(map[string]time.Time)
+)
+
+// metricsProxyLabel keeps arbitrary Host headers out of the label values:
+// requests are counted under the name of their proxy, so aliases and the
+// hosts of wildcard proxies add up, and under "pylon" when not routed to one.
+func metricsProxyLabel(info *requestInfo) string {
+	if info.Proxy == nil {
+		return "pylon"
+	}
+	return info.Proxy.External
+}
+
+func observeRequest(r *http.Request, info *requestInfo, status int, latency time.Duration) {
+	proxy := metricsProxyLabel(info)
+	requestsTotal.inc(proxy, fmt.Sprint(status))
+	requestDuration.observe(latency.Seconds(), proxy)
+}
+
+func recordConfigReload(err error) {
+	if err != nil {
+		configReloads.inc("failure")
+		return
+	}
+	configReloads.inc("success")
+	configLastReload.set(float64(time.Now().Unix()))
+}
+
+// markUserActive counts a logged in user towards pylon_active_sessions.
+// Sessions live in cookies, so this is the closest Pylon gets to a count.
+func markUserActive(email string) {
+	activeUsersMu.Lock()
+	activeUsers[email] = time.Now()
+	activeUsersMu.Unlock()
+}
+
+func countActiveUsers() int {
+	activeUsersMu.Lock()
+	defer activeUsersMu.Unlock()
+	for email, seen := range activeUsers {
+		if time.Since(seen) > activeSessionWindow {
+			delete(activeUsers, email)
+		}
+	}
+	return len(activeUsers)
+}
+
+// certificateExpiries reads the expiry of each certificate in the autocert
+// cache, by domain.
+func certificateExpiries() map[string]time.Time {
+	expiries := make(map[string]time.Time)
+	entries, err := os.ReadDir(certCacheDir)
+	if err != nil {
+		return expiries
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(certCacheDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		// Cache entries hold the private key followed by the chain, leaf first
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				break
+			}
+			domain := strings.TrimSuffix(entry.Name(), "+rsa")
+			if prev, found := expiries[domain]; !found || cert.NotAfter.Before(prev) {
+				expiries[domain] = cert.NotAfter
+			}
+			break
+		}
+	}
+	return expiries
+}
+
+// MetricsHandler serves all metrics in the Prometheus text format. They
+// cover every proxy, so delegated admins can't read them.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if admin := adminFromRequest(r); admin.Role == adminRoleDelegated {
+		writeAdminForbidden(w, admin)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	requestsTotal.write(w)
+	requestDuration.write(w)
+	upstreamErrors.write(w)
+	websocketConnections.write(w)
+	loginsTotal.write(w)
+
+	fmt.Fprintf(w, "# HELP pylon_active_sessions Logged in users seen in the last %.0f minutes.\n# TYPE pylon_active_sessions gauge\n", activeSessionWindow.Minutes())
+	fmt.Fprintf(w, "pylon_active_sessions %d\n", countActiveUsers())
+
+	configReloads.write(w)
+	configLastReload.write(w)
+
+	fmt.Fprintf(w, "# HELP pylon_upstream_up Whether the last health check of a proxy's target passed.\n# TYPE pylon_upstream_up gauge\n")
+	healthMu.Lock()
+	var lines []string
+	for key, h := range upstreamHealth {
+		if h.Status == healthUnknown {
+			continue
+		}
+		up := 0
+		if h.Status == healthUp {
+			up = 1
+		}
+		lines = append(lines, fmt.Sprintf("pylon_upstream_up{proxy=%q,target=%q} %d\n", key.external, key.target, up))
+	}
+	healthMu.Unlock()
+	sort.Strings(lines)
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+
+	fmt.Fprintf(w, "# HELP pylon_certificate_expiry_timestamp_seconds Expiry of the cached TLS certificates, by domain.\n# TYPE pylon_certificate_expiry_timestamp_seconds gauge\n")
+	expiries := certificateExpiries()
+	domains := make([]string, 0, len(expiries))
+	for domain := range expiries {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		fmt.Fprintf(w, "pylon_certificate_expiry_timestamp_seconds{domain=%q} %d\n", domain, expiries[domain].Unix())
+	}
+}
+
+// HealthzHandler reports that Pylon is running.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+// ReadyzHandler reports whether Pylon is serving proxy traffic: a config has
+// been loaded and the HTTPS listener is up.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if !server.isReady() {
+		http.Error(w, "proxy listener not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit configures a token bucket per client: requests are allowed in
+// bursts of up to Burst, refilling at RequestsPerSecond.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// Applied to the /pylon/ login endpoints when auth_rate_limit isn't set
+var defaultAuthRateLimit = RateLimit{RequestsPerSecond: 1, Burst: 20}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     RateLimit
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns nil, which allows everything, for a missing or
+// disabled limit.
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil || limit.RequestsPerSecond <= 0 {
+		return nil
+	}
+	l := *limit
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	return &rateLimiter{
+		limit:     l,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// reuseRateLimiter returns old when it already enforces limit, so reloading
+// the config doesn't hand every client a full bucket again.
+func reuseRateLimiter(old *rateLimiter, limit *RateLimit) *rateLimiter {
+	l := newRateLimiter(limit)
+	if l != nil && old != nil && old.limit == l.limit {
+		return old
+	}
+	return l
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// false and how long until a token is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b := l.refill(key, now)
+	if b.tokens < 1 {
+		return false, l.wait(b)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// exhausted reports, without taking a token, whether key's bucket is empty,
+// for limits on failures that are only counted once they happen.
+func (l *rateLimiter) exhausted(key string) (bool, time.Duration) {
+	if l == nil {
+		return false, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, time.Now())
+	if b.tokens < 1 {
+		return true, l.wait(b)
+	}
+	return false, 0
+}
+
+// refill returns key's bucket with the tokens earned since it was last used.
+// l.mu must be held.
+func (l *rateLimiter) refill(key string, now time.Time) *tokenBucket {
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.RequestsPerSecond)
+	b.last = now
+	return b
+}
+
+// wait is how long until bucket b has a token again.
+func (l *rateLimiter) wait(b *tokenBucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.limit.RequestsPerSecond * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled completely, so idle clients don't
+// accumulate. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.RequestsPerSecond * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// checkRateLimits applies each limiter in turn, writing a 429 and returning
+// false as soon as one is exhausted.
+func checkRateLimits(w http.ResponseWriter, key string, limiters ...*rateLimiter) bool {
+	for _, l := range limiters {
+		if ok, retryAfter := l.allow(key); !ok {
+			writeRateLimited(w, retryAfter)
+			return false
+		}
+	}
+	return true
+}
+
+func getGlobalRateLimiters() (*rateLimiter, *rateLimiter) {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return globalRateLimiter, authRateLimiter
+}
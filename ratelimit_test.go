@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   *RateLimit
+		calls   int
+		allowed int
+	}{
+		{"no limit", nil, 50, 50},
+		{"disabled", &RateLimit{RequestsPerSecond: 0, Burst: 5}, 50, 50},
+		{"burst", &RateLimit{RequestsPerSecond: 0.001, Burst: 5}, 10, 5},
+		{"burst defaults to 1", &RateLimit{RequestsPerSecond: 0.001}, 3, 1},
+	}
+	for _, tt := range tests {
+		l := newRateLimiter(tt.limit)
+		allowed := 0
+		for i := 0; i < tt.calls; i++ {
+			ok, retryAfter := l.allow("203.0.113.7")
+			if ok {
+				allowed++
+			} else if retryAfter <= 0 {
+				t.Errorf("%s: denied without a retry time", tt.name)
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: allowed %d of %d, want %d", tt.name, allowed, tt.calls, tt.allowed)
+		}
+	}
+}
+
+func TestRateLimiterKeysAndRefill(t *testing.T) {
+	l := newRateLimiter(&RateLimit{RequestsPerSecond: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d denied within the burst", i+1)
+		}
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Fatal("request past the burst allowed")
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Fatal("other key limited by a's bucket")
+	}
+
+	// A second later a token is back
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Second)
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatal("bucket didn't refill")
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Fatal("bucket refilled more than the rate")
+	}
+}
+
+func TestRateLimiterExhausted(t *testing.T) {
+	l := newRateLimiter(&RateLimit{RequestsPerSecond: 0.001, Burst: 1})
+	if blocked, _ := l.exhausted("a"); blocked {
+		t.Fatal("fresh bucket exhausted")
+	}
+	if blocked, _ := l.exhausted("a"); blocked {
+		t.Fatal("exhausted took a token")
+	}
+	l.allow("a")
+	if blocked, retryAfter := l.exhausted("a"); !blocked || retryAfter <= 0 {
+		t.Fatalf("exhausted = %v, %v after the only token was taken", blocked, retryAfter)
+	}
+}
+
+func TestReuseRateLimiter(t *testing.T) {
+	old := newRateLimiter(&RateLimit{RequestsPerSecond: 1, Burst: 10})
+	tests := []struct {
+		name  string
+		limit *RateLimit
+		reuse bool
+	}{
+		{"unchanged", &RateLimit{RequestsPerSecond: 1, Burst: 10}, true},
+		{"new rate", &RateLimit{RequestsPerSecond: 2, Burst: 10}, false},
+		{"new burst", &RateLimit{RequestsPerSecond: 1, Burst: 20}, false},
+		{"removed", nil, false},
+	}
+	for _, tt := range tests {
+		if got := reuseRateLimiter(old, tt.limit); (got == old) != tt.reuse {
+			t.Errorf("%s: reused = %v, want %v", tt.name, got == old, tt.reuse)
+		}
+	}
+	if reuseRateLimiter(old, nil) != nil {
+		t.Error("removed limit not disabled")
+	}
+}
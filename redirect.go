@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redirect makes a proxy entry answer every request with a redirect instead
+// of proxying, e.g. www.example.com to https://example.com.
+type Redirect struct {
+	// Absolute URL to send visitors to. Wildcard hosts can fill in their
+	// labels with {1}, {2}, ...
+	To string `json:"to"`
+	// 301 (or 308 for other methods than GET and HEAD) instead of 302 (307)
+	Permanent bool `json:"permanent,omitempty"`
+	// Appends the request's path and query to To
+	PreservePath bool `json:"preserve_path,omitempty"`
+}
+
+func (rd *Redirect) validate(external string) error {
+	if err := checkHostTemplates(external, []string{rd.To}); err != nil {
+		return err
+	}
+	u, err := url.Parse(sampleHostTemplate(external, rd.To))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("redirect of %s must be an absolute http or https URL", external)
+	}
+	return nil
+}
+
+// redirect answers a request to a redirect-only proxy.
+func (pd *ProxyDetails) redirect(w http.ResponseWriter, r *http.Request) {
+	target := expandHostTemplate(pd.Redirect.To, hostCaptures(r.Host))
+	if pd.Redirect.PreservePath {
+		target = strings.TrimSuffix(target, "/") + r.URL.EscapedPath()
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+	}
+
+	status := http.StatusFound
+	if pd.Redirect.Permanent {
+		status = http.StatusMovedPermanently
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		if pd.Redirect.Permanent {
+			status = http.StatusPermanentRedirect
+		} else {
+			status = http.StatusTemporaryRedirect
+		}
+	}
+	http.Redirect(w, r, target, status)
+}
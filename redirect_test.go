@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedirectValidate(t *testing.T) {
+	tests := []struct {
+		external string
+		to       string
+		ok       bool
+	}{
+		{"www.example.com", "https://example.com", true},
+		{"www.example.com", "http://example.com/landing?from=www", true},
+		{"*.old.example.com", "https://{1}.example.com", true},
+		{"www.example.com", "example.com", false},
+		{"www.example.com", "/landing", false},
+		{"www.example.com", "ftp://example.com", false},
+		{"www.example.com", "https://{1}.example.com", false},
+		{"*.old.example.com", "https://{2}.example.com", false},
+	}
+	for _, tt := range tests {
+		err := (&Redirect{To: tt.to}).validate(tt.external)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s to %s: %v", tt.external, tt.to, err)
+		}
+	}
+}
+
+func TestProxyRedirect(t *testing.T) {
+	www := &ProxyDetails{Redirect: &Redirect{To: "https://example.com/", PreservePath: true}}
+	old := &ProxyDetails{Redirect: &Redirect{To: "https://{1}.example.com", Permanent: true}}
+	useTestProxies(t, map[string]*ProxyDetails{"www.example.com": www, "*.old.example.com": old}, nil)
+	pattern, err := compileHostPattern("*.old.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxiesMu.Lock()
+	delete(proxies, "*.old.example.com")
+	wildcardProxies = []wildcardProxy{{pattern: pattern, details: old}}
+	proxiesMu.Unlock()
+
+	tests := []struct {
+		pd       *ProxyDetails
+		method   string
+		target   string
+		status   int
+		location string
+	}{
+		{www, "GET", "https://www.example.com/docs/a%20b?q=1", 302, "https://example.com/docs/a%20b?q=1"},
+		{www, "HEAD", "https://www.example.com/", 302, "https://example.com/"},
+		{www, "POST", "https://www.example.com/form", 307, "https://example.com/form"},
+		{old, "GET", "https://wiki.old.example.com/page?q=1", 301, "https://wiki.example.com"},
+		{old, "PUT", "https://wiki.old.example.com/page", 308, "https://wiki.example.com"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.pd.redirect(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s: %d to %s, want %d to %s", tt.method, tt.target, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
+
+func TestConfigHosts(t *testing.T) {
+	chdirTemp(t)
+	useTestProxies(t, nil, nil)
+	cfgMu.RLock()
+	savedCfg, savedStore := cfg, store
+	cfgMu.RUnlock()
+	defer func() {
+		cfgMu.Lock()
+		cfg, store = savedCfg, savedStore
+		cfgMu.Unlock()
+	}()
+
+	tests := []struct {
+		name    string
+		proxies string
+		err     string
+	}{
+		{
+			name:    "alias of another proxy's external",
+			proxies: `{"external": "wiki.example.com", "internal": "http://wiki"}, {"external": "docs.example.com", "internal": "http://docs", "aliases": ["wiki.example.com"]}`,
+			err:     "host wiki.example.com is configured for both wiki.example.com and docs.example.com",
+		},
+		{
+			name:    "alias shared by two proxies",
+			proxies: `{"external": "wiki.example.com", "internal": "http://wiki", "aliases": ["w.example.com"]}, {"external": "docs.example.com", "internal": "http://docs", "aliases": ["w.example.com"]}`,
+			err:     "host w.example.com is configured for both wiki.example.com and docs.example.com",
+		},
+		{
+			name:    "alias repeating the external",
+			proxies: `{"external": "wiki.example.com", "internal": "http://wiki", "aliases": ["wiki.example.com"]}`,
+			err:     "host wiki.example.com is configured for both",
+		},
+		{
+			name:    "redirect to a relative URL",
+			proxies: `{"external": "www.example.com", "redirect": {"to": "/home"}}`,
+			err:     "redirect of www.example.com must be an absolute http or https URL",
+		},
+		{
+			name:    "redirect template beyond an alias's wildcards",
+			proxies: `{"external": "*.old.example.com", "aliases": ["old.example.com"], "redirect": {"to": "https://{1}.example.com"}}`,
+			err:     "refers to {1}, but the host has 0 wildcards",
+		},
+		{
+			name:    "redirect and static site",
+			proxies: `{"external": "www.example.com", "redirect": {"to": "https://example.com"}, "static": {"root": "."}}`,
+			err:     "can't both redirect and serve a static site",
+		},
+		{
+			name:    "aliases and redirect",
+			proxies: `{"external": "wiki.example.com", "internal": "http://wiki", "aliases": ["w.example.com", "*.wiki.example.com"]}, {"external": "www.example.com", "aliases": ["example.net"], "redirect": {"to": "https://example.com"}}`,
+		},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile("config.json", []byte(`{"proxies": [`+tt.proxies+`]}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := loadConfig()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	// Aliases serve the very proxy of their external
+	wiki, _ := lookupProxyByName("wiki.example.com")
+	for _, host := range []string{"wiki.example.com", "w.example.com", "team.wiki.example.com"} {
+		if pd, found := lookupProxy(host); !found || pd != wiki {
+			t.Errorf("%s isn't served by wiki.example.com", host)
+		}
+	}
+	if pd, found := lookupProxy("example.net"); !found || pd.Redirect == nil || pd.External != "www.example.com" {
+		t.Error("example.net doesn't redirect")
+	}
+	if _, found := lookupProxyByName("w.example.com"); found {
+		t.Error("alias listed as a proxy")
+	}
+}
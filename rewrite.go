@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule changes the URL of matching requests before they are
+// forwarded, or redirects the client to the new URL.
+type RewriteRule struct {
+	// Regex matched against the path, or against the path and query
+	// ("/search?q=x") with MatchQuery
+	Match      string `json:"match"`
+	MatchQuery bool   `json:"match_query,omitempty"`
+	// Replaces the whole path (and query) on a match, with $1 or ${name}
+	// for capture groups. A query in Replace is kept, followed by the
+	// original query unless MatchQuery is set.
+	Replace string `json:"replace"`
+	// Redirects the client with this status (301, 302, 303, 307 or 308)
+	// instead of rewriting the request. Redirects may go to absolute URLs.
+	Redirect int `json:"redirect,omitempty"`
+	// Skips the rules after this one when it matched. Redirects always
+	// stop.
+	Last bool `json:"last,omitempty"`
+}
+
+type rewriteRule struct {
+	RewriteRule
+	match *regexp.Regexp
+}
+
+func compileRewrites(external string, rules []RewriteRule) ([]*rewriteRule, error) {
+	var compiled []*rewriteRule
+	for i, rule := range rules {
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %d of %s: invalid match regex: %v", i+1, external, err)
+		}
+		switch rule.Redirect {
+		case 0:
+			if !strings.HasPrefix(rule.Replace, "/") && !strings.HasPrefix(rule.Replace, "$") {
+				return nil, fmt.Errorf("rewrite %d of %s: replacement %q must be a path", i+1, external, rule.Replace)
+			}
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("rewrite %d of %s: %d is not a redirect status", i+1, external, rule.Redirect)
+		}
+		compiled = append(compiled, &rewriteRule{RewriteRule: rule, match: match})
+	}
+	return compiled, nil
+}
+
+// rewrite applies the proxy's rewrite rules to r in order. When a redirect
+// rule matches it returns where to send the client instead.
+func (pd *ProxyDetails) rewrite(r *http.Request) (location string, status int) {
+	for _, rule := range pd.Rewrites {
+		// The path as sent, so an escaped / in a capture stays escaped
+		subject := r.URL.EscapedPath()
+		if rule.MatchQuery && r.URL.RawQuery != "" {
+			subject += "?" + r.URL.RawQuery
+		}
+		m := rule.match.FindStringSubmatchIndex(subject)
+		if m == nil {
+			continue
+		}
+
+		// Only a ? in Replace starts the query; one captured from the
+		// query is part of the path
+		pathTemplate, queryTemplate := rule.Replace, ""
+		if i := strings.Index(rule.Replace, "?"); i >= 0 {
+			pathTemplate, queryTemplate = rule.Replace[:i], rule.Replace[i+1:]
+		}
+		path := string(rule.match.ExpandString(nil, pathTemplate, subject, m))
+		path = strings.Replace(path, "?", "%3F", -1)
+		query := string(rule.match.ExpandString(nil, queryTemplate, subject, m))
+		if !rule.MatchQuery && r.URL.RawQuery != "" {
+			if query != "" {
+				query += "&"
+			}
+			query += r.URL.RawQuery
+		}
+
+		if rule.Redirect != 0 {
+			// A path starting with // is a URL of another site to browsers
+			if strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+				log.Printf("Rewrite %q of %s refused: redirect to %q leaves the site", rule.Match, pd.External, path)
+				continue
+			}
+			if query != "" {
+				path += "?" + query
+			}
+			return path, rule.Redirect
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		unescaped, err := url.PathUnescape(path)
+		if err != nil {
+			log.Printf("Rewrite %q of %s refused: invalid path %q", rule.Match, pd.External, path)
+			continue
+		}
+		r.URL.Path = unescaped
+		r.URL.RawPath = path
+		r.URL.RawQuery = query
+		if rule.Last {
+			break
+		}
+	}
+	return "", 0
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []RewriteRule
+		target   string
+		path     string // decoded path after rewriting
+		escaped  string
+		query    string
+		location string
+		status   int
+	}{
+		{
+			name:   "no match",
+			rules:  []RewriteRule{{Match: `^/old/`, Replace: "/new/"}},
+			target: "/other?a=1",
+			path:   "/other", escaped: "/other", query: "a=1",
+		},
+		{
+			name:   "capture and original query",
+			rules:  []RewriteRule{{Match: `^/old/(.*)$`, Replace: "/new/$1"}},
+			target: "/old/page?a=1",
+			path:   "/new/page", escaped: "/new/page", query: "a=1",
+		},
+		{
+			name:   "named capture",
+			rules:  []RewriteRule{{Match: `^/u/(?P<user>[^/]+)$`, Replace: "/users/${user}/profile"}},
+			target: "/u/bob",
+			path:   "/users/bob/profile", escaped: "/users/bob/profile",
+		},
+		{
+			name:   "escaped slash stays escaped",
+			rules:  []RewriteRule{{Match: `^/files/(.*)$`, Replace: "/f/$1"}},
+			target: "/files/a%2Fb",
+			path:   "/f/a/b", escaped: "/f/a%2Fb",
+		},
+		{
+			name:   "query from the template",
+			rules:  []RewriteRule{{Match: `^/s/(.*)$`, Replace: "/search?q=$1"}},
+			target: "/s/pylon?page=2",
+			path:   "/search", escaped: "/search", query: "q=pylon&page=2",
+		},
+		{
+			name:   "matched query replaces the original",
+			rules:  []RewriteRule{{Match: `^/find\?term=(.*)$`, MatchQuery: true, Replace: "/search?q=$1"}},
+			target: "/find?term=pylon",
+			path:   "/search", escaped: "/search", query: "q=pylon",
+		},
+		{
+			name:   "captured ? stays in the path",
+			rules:  []RewriteRule{{Match: `^/go(.*)$`, MatchQuery: true, Replace: "/r$1"}},
+			target: "/go?to=x",
+			path:   "/r?to=x", escaped: "/r%3Fto=x",
+		},
+		{
+			name: "rules apply in order",
+			rules: []RewriteRule{
+				{Match: `^/a$`, Replace: "/b"},
+				{Match: `^/b$`, Replace: "/c"},
+			},
+			target: "/a",
+			path:   "/c", escaped: "/c",
+		},
+		{
+			name: "last stops",
+			rules: []RewriteRule{
+				{Match: `^/a$`, Replace: "/b", Last: true},
+				{Match: `^/b$`, Replace: "/c"},
+			},
+			target: "/a",
+			path:   "/b", escaped: "/b",
+		},
+		{
+			name:   "redirect",
+			rules:  []RewriteRule{{Match: `^/old(.*)$`, Replace: "https://new.example.com$1", Redirect: 301}},
+			target: "/old/page?a=1",
+			path:   "/old/page", escaped: "/old/page", query: "a=1",
+			location: "https://new.example.com/page?a=1", status: 301,
+		},
+		{
+			name:   "redirect to another site refused",
+			rules:  []RewriteRule{{Match: `^/out/(.*)$`, Replace: "/$1", Redirect: 302}},
+			target: "/out//evil.example.com",
+			path:   "/out//evil.example.com", escaped: "/out//evil.example.com",
+		},
+		{
+			name:   "redirect to another site with a backslash refused",
+			rules:  []RewriteRule{{Match: `^/out/(.*)$`, Replace: `/\$1`, Redirect: 302}},
+			target: "/out/evil.example.com",
+			path:   "/out/evil.example.com", escaped: "/out/evil.example.com",
+		},
+	}
+	for _, tt := range tests {
+		rewrites, err := compileRewrites("app.example.com", tt.rules)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		pd := &ProxyDetails{External: "app.example.com", Rewrites: rewrites}
+		r := httptest.NewRequest("GET", tt.target, nil)
+		location, status := pd.rewrite(r)
+		if location != tt.location || status != tt.status {
+			t.Errorf("%s: redirect %q %d, want %q %d", tt.name, location, status, tt.location, tt.status)
+		}
+		if r.URL.Path != tt.path || r.URL.EscapedPath() != tt.escaped || r.URL.RawQuery != tt.query {
+			t.Errorf("%s: got %q (%q) ?%q, want %q (%q) ?%q", tt.name, r.URL.Path, r.URL.EscapedPath(), r.URL.RawQuery, tt.path, tt.escaped, tt.query)
+		}
+	}
+}
+
+func TestCompileRewrites(t *testing.T) {
+	tests := []struct {
+		rule RewriteRule
+		ok   bool
+	}{
+		{RewriteRule{Match: `^/a$`, Replace: "/b"}, true},
+		{RewriteRule{Match: `^/(.*)$`, Replace: "$1"}, true},
+		{RewriteRule{Match: `^/a$`, Replace: "https://b.example.com/"}, false},
+		{RewriteRule{Match: `^/a$`, Replace: "https://b.example.com/", Redirect: 308}, true},
+		{RewriteRule{Match: `^/a$`, Replace: "/b", Redirect: 200}, false},
+		{RewriteRule{Match: `^/(a$`, Replace: "/b"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := compileRewrites("app.example.com", []RewriteRule{tt.rule}); (err == nil) != tt.ok {
+			t.Errorf("%+v: error %v", tt.rule, err)
+		}
+	}
+}
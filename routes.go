@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Route sends part of a proxy's paths to its own upstream and/or with its own
+// access policy. Routes are tried in order and the first match wins; requests
+// matching none use the proxy itself.
+type Route struct {
+	// Exactly one of these: "/api" matches /api and /api/..., the regex is
+	// matched against the path
+	PathPrefix string `json:"path_prefix,omitempty"`
+	PathRegex  string `json:"path_regex,omitempty"`
+	// Removes PathPrefix before forwarding, so /api/users reaches the
+	// upstream as /users
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+
+	// Upstream for the route, defaulting to the proxy's
+	Internal      string         `json:"internal,omitempty"`
+	Targets       []string       `json:"targets,omitempty"`
+	LoadBalancing *LoadBalancing `json:"load_balancing,omitempty"`
+	// Serves a local directory instead
+	Static *StaticSite `json:"static,omitempty"`
+
+	// Access policy, defaulting to the proxy's. Public routes need no login.
+	Public             bool          `json:"public,omitempty"`
+	AllowedUsers       []AllowedUser `json:"allowed_users,omitempty"`
+	AllowedGithubOrgs  []string      `json:"allowed_github_orgs,omitempty"`
+	AllowedGithubTeams []string      `json:"allowed_github_teams,omitempty"`
+	AllowedProviders   []string      `json:"allowed_providers,omitempty"`
+	MaxAuthAge         Duration      `json:"max_auth_age,omitempty"`
+}
+
+// proxyRoute is a compiled Route. details is the proxy with the route's
+// upstream and policy applied.
+type proxyRoute struct {
+	prefix  string
+	regex   *regexp.Regexp
+	details *ProxyDetails
+}
+
+// compileRoutes builds the routes of proxy pd, keeping the failure state of
+// upstreams that were in old.
+func compileRoutes(external string, pd *ProxyDetails, routes []Route, insecureSkipVerify bool, old *ProxyDetails) ([]*proxyRoute, error) {
+	var compiled []*proxyRoute
+	for i, route := range routes {
+		rt := &proxyRoute{prefix: route.PathPrefix}
+		switch {
+		case route.PathPrefix != "" && route.PathRegex != "":
+			return nil, fmt.Errorf("route %d of %s has both a path prefix and a path regex", i+1, external)
+		case route.PathPrefix != "":
+			if !strings.HasPrefix(route.PathPrefix, "/") {
+				return nil, fmt.Errorf("route %d of %s: path prefix %q must start with /", i+1, external, route.PathPrefix)
+			}
+		case route.PathRegex != "":
+			if route.StripPrefix {
+				return nil, fmt.Errorf("route %d of %s: strip_prefix needs a path prefix", i+1, external)
+			}
+			regex, err := regexp.Compile(route.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route %d of %s: invalid path regex: %v", i+1, external, err)
+			}
+			rt.regex = regex
+		default:
+			return nil, fmt.Errorf("route %d of %s has no path prefix or path regex", i+1, external)
+		}
+
+		details := *pd
+		details.Routes = nil
+		targets := upstreamTargets(route.Internal, route.Targets)
+		if route.Static != nil {
+			if len(targets) > 0 {
+				return nil, fmt.Errorf("route %d of %s can't both proxy and serve a static site", i+1, external)
+			}
+			static, err := newStaticSite(external, route.Static)
+			if err != nil {
+				return nil, err
+			}
+			details.Static = static
+		}
+		if len(targets) > 0 {
+			var oldUpstreams *upstreamPool
+			if oldRoute := old.sameRoute(route); oldRoute != nil {
+				oldUpstreams = oldRoute.details.Upstreams
+			}
+			upstreams, err := newUpstreamPool(external, targets, route.LoadBalancing, insecureSkipVerify, oldUpstreams)
+			if err != nil {
+				return nil, err
+			}
+			details.Upstreams = upstreams
+			details.Internal = targets[0]
+			details.Static = nil
+		}
+		if route.StripPrefix {
+			details.StripPrefix = strings.TrimSuffix(route.PathPrefix, "/")
+		}
+		details.Public = route.Public
+		if len(route.AllowedUsers) > 0 || len(route.AllowedGithubOrgs) > 0 || len(route.AllowedGithubTeams) > 0 {
+			details.AllowedUsers = route.AllowedUsers
+			details.AllowedGithubOrgs = route.AllowedGithubOrgs
+			details.AllowedGithubTeams = route.AllowedGithubTeams
+			details.RoutePolicy = true
+		}
+		if len(route.AllowedProviders) > 0 {
+			details.AllowedProviders = route.AllowedProviders
+		}
+		if route.MaxAuthAge > 0 {
+			details.MaxAuthAge = time.Duration(route.MaxAuthAge)
+		}
+		rt.details = &details
+		compiled = append(compiled, rt)
+	}
+	return compiled, nil
+}
+
+// sameRoute returns the route of the proxy matching the same paths as
+// route, if any, so routes keep their upstream state when others are added
+// or reordered.
+func (pd *ProxyDetails) sameRoute(route Route) *proxyRoute {
+	if pd == nil {
+		return nil
+	}
+	for _, rt := range pd.Routes {
+		if route.PathPrefix != "" && rt.prefix == route.PathPrefix {
+			return rt
+		}
+		if route.PathRegex != "" && rt.regex != nil && rt.regex.String() == route.PathRegex {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (rt *proxyRoute) matches(path string) bool {
+	if rt.regex != nil {
+		return rt.regex.MatchString(path)
+	}
+	if rt.prefix == "/" || path == rt.prefix {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(rt.prefix, "/")+"/")
+}
+
+// route returns the details to handle path with: those of the first matching
+// route, or the proxy's own.
+func (pd *ProxyDetails) route(path string) *ProxyDetails {
+	for _, rt := range pd.Routes {
+		if rt.matches(path) {
+			return rt.details
+		}
+	}
+	return pd
+}
+
+// stripPrefix removes the route's prefix from the request path before it is
+// forwarded, telling the upstream what was removed.
+func (pd *ProxyDetails) stripPrefix(r *http.Request) {
+	if pd.StripPrefix == "" {
+		return
+	}
+	r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, pd.StripPrefix), "/")
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.RawPath, pd.StripPrefix), "/")
+	}
+	r.Header.Set("X-Forwarded-Prefix", pd.StripPrefix)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestProxyRouteMatches(t *testing.T) {
+	tests := []struct {
+		prefix string
+		regex  string
+		path   string
+		want   bool
+	}{
+		{"/api", "", "/api", true},
+		{"/api", "", "/api/", true},
+		{"/api", "", "/api/users", true},
+		{"/api", "", "/apis", false},
+		{"/api", "", "/", false},
+		{"/api/", "", "/api", false},
+		{"/api/", "", "/api/users", true},
+		{"/", "", "/anything", true},
+		{"", `^/v[0-9]+/`, "/v2/users", true},
+		{"", `^/v[0-9]+/`, "/docs/v2/", false},
+		{"", `\.php$`, "/index.php", true},
+	}
+	for _, tt := range tests {
+		rt := &proxyRoute{prefix: tt.prefix}
+		if tt.regex != "" {
+			rt.regex = regexp.MustCompile(tt.regex)
+		}
+		if got := rt.matches(tt.path); got != tt.want {
+			t.Errorf("prefix %q regex %q: matches(%q) = %v, want %v", tt.prefix, tt.regex, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		strip   string
+		target  string
+		path    string
+		rawPath string
+		prefix  string
+	}{
+		{"", "/api/users", "/api/users", "", ""},
+		{"/api", "/api/users", "/users", "", "/api"},
+		{"/api", "/api", "/", "", "/api"},
+		{"/api", "/api/", "/", "", "/api"},
+		{"/api", "/api/a%2Fb", "/a/b", "/a%2Fb", "/api"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		pd := &ProxyDetails{StripPrefix: tt.strip}
+		pd.stripPrefix(r)
+		if r.URL.Path != tt.path || r.URL.RawPath != tt.rawPath || r.Header.Get("X-Forwarded-Prefix") != tt.prefix {
+			t.Errorf("%q stripping %q: got path %q raw %q prefix %q, want %q %q %q", tt.target, tt.strip, r.URL.Path, r.URL.RawPath, r.Header.Get("X-Forwarded-Prefix"), tt.path, tt.rawPath, tt.prefix)
+		}
+	}
+}
+
+func TestSameRoute(t *testing.T) {
+	api := &proxyRoute{prefix: "/api"}
+	versioned := &proxyRoute{regex: regexp.MustCompile(`^/v[0-9]+/`)}
+	old := &ProxyDetails{Routes: []*proxyRoute{api, versioned}}
+
+	tests := []struct {
+		route Route
+		want  *proxyRoute
+	}{
+		{Route{PathPrefix: "/api"}, api},
+		{Route{PathRegex: `^/v[0-9]+/`}, versioned},
+		{Route{PathPrefix: "/admin"}, nil},
+		{Route{PathRegex: "/api"}, nil},
+	}
+	for _, tt := range tests {
+		if got := old.sameRoute(tt.route); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.route, got, tt.want)
+		}
+	}
+	if (*ProxyDetails)(nil).sameRoute(Route{PathPrefix: "/api"}) != nil {
+		t.Error("new proxy has old routes")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// StaticSite makes a proxy entry, or one of its routes, serve the files of a
+// local directory instead of forwarding to an upstream. Access is checked
+// as for any other proxy.
+type StaticSite struct {
+	// Directory to serve
+	Root string `json:"root"`
+	// Serves /index.html for paths without a file extension that match no
+	// file, so single page apps can do their own routing
+	SPA bool `json:"spa,omitempty"`
+	// Lists the files of directories without an index.html instead of
+	// answering 404
+	DirectoryListing bool `json:"directory_listing,omitempty"`
+	// Cache-Control header of the files, e.g. "public, max-age=86400". HTML
+	// pages are always sent with "no-cache" so new deploys show up.
+	CacheControl string `json:"cache_control,omitempty"`
+}
+
+// Precompressed variants looked for next to a file, in order of preference
+var staticEncodings = []struct {
+	encoding string
+	ext      string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type staticSite struct {
+	conf  StaticSite
+	fs    http.FileSystem
+	files http.Handler
+}
+
+func newStaticSite(external string, conf *StaticSite) (*staticSite, error) {
+	if conf.Root == "" {
+		return nil, fmt.Errorf("static site of %s has no root", external)
+	}
+	info, err := os.Stat(conf.Root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid static site root of %s: %v", external, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("static site root %s of %s is not a directory", conf.Root, external)
+	}
+	fs := staticFileSystem{root: http.Dir(conf.Root), listing: conf.DirectoryListing}
+	return &staticSite{conf: *conf, fs: fs, files: http.FileServer(fs)}, nil
+}
+
+func (s *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	found := s.exists(name)
+	if !found && s.conf.SPA && path.Ext(name) == "" {
+		r.URL.Path = "/"
+		name = "/index.html"
+		found = s.exists(name)
+	}
+
+	if !found {
+		// The file server answers 404, without cache headers
+		s.files.ServeHTTP(w, r)
+		return
+	}
+
+	if ext := path.Ext(name); ext == "" || ext == ".html" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else if s.conf.CacheControl != "" {
+		w.Header().Set("Cache-Control", s.conf.CacheControl)
+	}
+	if s.servePrecompressed(w, r, name) {
+		return
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+func (s *staticSite) exists(name string) bool {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// servePrecompressed sends the .br or .gz file next to the requested one
+// when the client accepts that encoding.
+func (s *staticSite) servePrecompressed(w http.ResponseWriter, r *http.Request, name string) bool {
+	for _, variant := range staticEncodings {
+		f, err := s.fs.Open(name + variant.ext)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			f.Close()
+			continue
+		}
+		// Caches must keep the encodings apart even when this client
+		// gets the plain file
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !acceptsEncoding(r, variant.encoding) {
+			f.Close()
+			continue
+		}
+		defer f.Close()
+
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Encoding", variant.encoding)
+		http.ServeContent(w, r, name, info.ModTime(), f)
+		return true
+	}
+	return false
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// encoding, honouring q=0 exclusions.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), encoding) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") && strings.Trim(q[2:], "0.") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// staticFileSystem hides dotfiles such as .git, and directories without an
+// index.html unless listings are enabled.
+type staticFileSystem struct {
+	root    http.FileSystem
+	listing bool
+}
+
+func (fs staticFileSystem) Open(name string) (http.File, error) {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	f, err := fs.root.Open(name)
+	if err != nil || fs.listing {
+		return f, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := fs.root.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
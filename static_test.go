@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		want     bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"gzip, deflate, br", "br", true},
+		{"gzip, deflate", "br", false},
+		{"GZIP", "gzip", true},
+		{"br;q=1.0, gzip;q=0.8", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.000", "gzip", false},
+		{"gzip;q=0.001", "gzip", true},
+		{"br;q=0, gzip", "br", false},
+		{"x-gzip", "gzip", false},
+		{"*", "gzip", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Encoding", tt.header)
+		}
+		if got := acceptsEncoding(r, tt.encoding); got != tt.want {
+			t.Errorf("Accept-Encoding %q: accepts %s = %v, want %v", tt.header, tt.encoding, got, tt.want)
+		}
+	}
+}
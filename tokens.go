@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIToken is a Pylon-issued bearer credential accepted by proxies in its
+// scopes on behalf of the user who approved it. Only a hash of the token is
+// stored.
+type APIToken struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"` // "device" or "personal"
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Provider  string    `json:"provider"`
+	Hash      string    `json:"hash"`
+	Scopes    []string  `json:"scopes"` // externals of the proxies the token is valid for
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+const apiTokenPrefix = "pylon_"
+
+var (
+	tokensMu  sync.Mutex
+	apiTokens []*APIToken
+)
+
+// getDataPath places Pylon's own state files next to the config file.
+func getDataPath(name string) string {
+	return filepath.Join(filepath.Dir(getConfigPath()), name)
+}
+
+func loadTokens() error {
+	f, err := os.ReadFile(getDataPath("tokens.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var loaded []*APIToken
+	if err := json.Unmarshal(f, &loaded); err != nil {
+		return err
+	}
+
+	tokensMu.Lock()
+	apiTokens = loaded
+	tokensMu.Unlock()
+
+	revokeUnauthorizedTokens()
+	return nil
+}
+
+// scopeProxy returns the proxy a token scope names: its external or, as
+// requested by a CLI or stored by older versions, any host it serves.
+func scopeProxy(scope string) (*ProxyDetails, bool) {
+	if pd, found := lookupProxyByName(scope); found {
+		return pd, true
+	}
+	return lookupProxy(scope)
+}
+
+// saveTokensLocked writes the token store to disk. tokensMu must be held.
+func saveTokensLocked() error {
+	pretty, err := json.MarshalIndent(apiTokens, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getDataPath("tokens.json"), pretty, 0600)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueToken creates and stores a new token, returning the plain text value
+// which is never stored and can only be shown once.
+func issueToken(t APIToken, ttl time.Duration) (string, *APIToken, error) {
+	plain := apiTokenPrefix + generateState() + generateState()
+	t.ID = generateState()[:12]
+	t.Hash = hashToken(plain)
+	t.CreatedAt = time.Now()
+	if ttl > 0 {
+		t.ExpiresAt = t.CreatedAt.Add(ttl)
+	}
+
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	apiTokens = append(apiTokens, &t)
+	if err := saveTokensLocked(); err != nil {
+		apiTokens = apiTokens[:len(apiTokens)-1]
+		return "", nil, err
+	}
+	return plain, &t, nil
+}
+
+// lookupToken returns the stored token matching the plain text value if it
+// hasn't expired, recording its use.
+func lookupToken(plain string) (APIToken, bool) {
+	hash := hashToken(plain)
+
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	for _, t := range apiTokens {
+		if t.Hash != hash {
+			continue
+		}
+		if !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt) {
+			return APIToken{}, false
+		}
+		// Persist last-used times at most once a minute per token
+		if time.Since(t.LastUsed) > time.Minute {
+			t.LastUsed = time.Now()
+			if err := saveTokensLocked(); err != nil {
+				log.Printf("Failed to save token store: %v", err)
+			}
+		}
+		return *t, true
+	}
+	return APIToken{}, false
+}
+
+// revokeToken deletes a token by ID. If email is non-empty the token must
+// also belong to that user.
+func revokeToken(id string, email string) bool {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	for i, t := range apiTokens {
+		if t.ID == id && (email == "" || t.Email == email) {
+			apiTokens = append(apiTokens[:i], apiTokens[i+1:]...)
+			if err := saveTokensLocked(); err != nil {
+				log.Printf("Failed to save token store: %v", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// listTokens returns copies of the stored tokens, limited to one user when
+// email is non-empty.
+func listTokens(email string) []APIToken {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	list := []APIToken{}
+	for _, t := range apiTokens {
+		if email == "" || t.Email == email {
+			list = append(list, *t)
+		}
+	}
+	return list
+}
+
+// bearerToken returns a Pylon token from the Authorization header, ignoring
+// bearer credentials meant for the upstream itself.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer "+apiTokenPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// tokenIdentity authenticates a bearer token for the proxy with the given
+// external, whichever of its hosts the request was made to.
+func tokenIdentity(plain string, external string) (authIdentity, bool) {
+	t, ok := lookupToken(plain)
+	if !ok || !sliceContains(t.Scopes, external) {
+		return authIdentity{}, false
+	}
+	return authIdentity{
+		Email:    t.Email,
+		Provider: t.Provider,
+		AuthTime: t.CreatedAt,
+		TokenID:  t.ID,
+	}, true
+}
+
+// TokensHandler lets admins list and revoke every issued token. Delegated
+// admins only see tokens scoped to their own proxies.
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	enableAdminCORS(&w, r)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method == "GET" {
+		admin := adminFromRequest(r)
+		tokens := []APIToken{}
+		for _, t := range listTokens("") {
+			visible := true
+			for _, scope := range t.Scopes {
+				visible = visible && admin.seesProxy(scope)
+			}
+			if visible {
+				t.Hash = ""
+				tokens = append(tokens, t)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if admin := adminFromRequest(r); !admin.canEdit() {
+			writeAdminForbidden(w, admin)
+			return
+		}
+		if !revokeToken(r.URL.Query().Get("id"), "") {
+			http.Error(w, "Token Not Found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("okay"))
+		return
+	}
+
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
+
+// revokeUnauthorizedTokens drops tokens scoped to proxies their owner may no
+// longer access, e.g. after being removed from an allow list. Scopes naming
+// a proxy by another of its hosts are changed to its external.
+func revokeUnauthorizedTokens() {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	changed := false
+	kept := apiTokens[:0]
+	for _, t := range apiTokens {
+		authorized := true
+		for i, scope := range t.Scopes {
+			pd, found := scopeProxy(scope)
+			if !found || !pd.authorizes(authIdentity{Email: t.Email, Provider: t.Provider}) {
+				authorized = false
+				break
+			}
+			if scope != pd.External {
+				t.Scopes[i] = pd.External
+				changed = true
+			}
+		}
+		if authorized {
+			kept = append(kept, t)
+		} else {
+			log.Printf("Revoking %s token %q of %s: no longer authorized for its scopes", t.Kind, t.Name, t.Email)
+		}
+	}
+	if len(kept) == len(apiTokens) && !changed {
+		return
+	}
+	apiTokens = kept
+	if err := saveTokensLocked(); err != nil {
+		log.Printf("Failed to save token store: %v", err)
+	}
+}
+
+// personalTokensHandler is the self-service page where logged in users mint
+// and revoke personal access tokens for the proxies they can access.
+func personalTokensHandler(w http.ResponseWriter, r *http.Request) {
+	sessionStore := getSessionStore()
+	session, _ := sessionStore.Get(r, "pylon")
+	if session.Values["email"] == nil {
+		redirectToLogin(w, r)
+		return
+	}
+	id := sessionIdentity(w, r, session)
+
+	cfgMu.RLock()
+	proxiesList := cfg.Proxies
+	cfgMu.RUnlock()
+
+	var allowedHosts []string
+	for _, proxy := range proxiesList {
+		pd, found := lookupProxyByName(proxy.External)
+		if found && pd.authorizes(authIdentity{Email: id.Email}) && pd.acceptsProvider(id.Provider) {
+			allowedHosts = append(allowedHosts, proxy.External)
+		}
+	}
+
+	var notice string
+	if r.Method == "POST" {
+		if !checkCSRF(w, r, id) {
+			return
+		}
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			scopes := r.Form["scope"]
+			if name == "" || len(scopes) == 0 {
+				notice = "A token needs a name and at least one service."
+				break
+			}
+			for _, scope := range scopes {
+				if !sliceContains(allowedHosts, scope) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			days, _ := strconv.Atoi(r.FormValue("expires_days"))
+			plain, _, err := issueToken(APIToken{
+				Kind:     "personal",
+				Name:     name,
+				Email:    id.Email,
+				Provider: id.Provider,
+				Scopes:   scopes,
+			}, time.Duration(days)*24*time.Hour)
+			if err != nil {
+				log.Printf("Failed to issue personal token for %s: %v", id.Email, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			notice = fmt.Sprintf(`Token created. Copy it now, it won't be shown again:<br><code style="word-break: break-all; color: #f8fafc;">%s</code>`, plain)
+		case "revoke":
+			if revokeToken(r.FormValue("id"), id.Email) {
+				notice = "Token revoked."
+			}
+		}
+	}
+
+	var content strings.Builder
+	if notice != "" {
+		content.WriteString(`<p style="margin-bottom: 24px;">` + notice + `</p>`)
+	}
+
+	content.WriteString(`<ul class="pylon-list">`)
+	for _, t := range listTokens(id.Email) {
+		expires := "never"
+		if !t.ExpiresAt.IsZero() {
+			expires = t.ExpiresAt.Format("2006-01-02")
+		}
+		lastUsed := "never"
+		if !t.LastUsed.IsZero() {
+			lastUsed = t.LastUsed.Format("2006-01-02 15:04")
+		}
+		content.WriteString(fmt.Sprintf(`
+			<li style="margin-bottom: 12px;">
+				<strong>%s</strong> (%s) &ndash; %s<br>
+				expires %s, last used %s
+				<form method="POST" action="/pylon/tokens" style="display: inline;">
+					<input type="hidden" name="action" value="revoke">
+					<input type="hidden" name="id" value="%s">
+					%s
+					<button type="submit" style="background: none; border: none; color: #f87171; cursor: pointer;">Revoke</button>
+				</form>
+			</li>
+		`, html.EscapeString(t.Name), t.Kind, html.EscapeString(strings.Join(t.Scopes, ", ")), expires, lastUsed, t.ID, csrfField(id)))
+	}
+	content.WriteString(`</ul>`)
+
+	var scopesHTML strings.Builder
+	for _, host := range allowedHosts {
+		scopesHTML.WriteString(fmt.Sprintf(`<label style="display: block;"><input type="checkbox" name="scope" value="%s"> %s</label>`,
+			html.EscapeString(host), html.EscapeString(host)))
+	}
+	content.WriteString(fmt.Sprintf(`
+		<form method="POST" action="/pylon/tokens">
+			<input type="hidden" name="action" value="create">
+			%s
+			<input class="pylon-input" name="name" placeholder="Token name" autocomplete="off">
+			<select class="pylon-input" name="expires_days">
+				<option value="7">Expires in 7 days</option>
+				<option value="30" selected>Expires in 30 days</option>
+				<option value="90">Expires in 90 days</option>
+				<option value="365">Expires in 1 year</option>
+				<option value="0">Never expires</option>
+			</select>
+			<div class="pylon-list">%s</div>
+			<button class="login-btn" type="submit" style="background-color: #4f46e5;">Create Token</button>
+		</form>
+	`, csrfField(id), scopesHTML.String()))
+
+	writePylonPage(w, http.StatusOK, "Pylon Access Tokens", fmt.Sprintf("Personal access tokens for %s", id.Email), content.String())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chdirTemp moves the test into an empty directory, where Pylon keeps its
+// config and state files.
+func chdirTemp(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestTokenLookupAndRevocation(t *testing.T) {
+	chdirTemp(t)
+	defer func() {
+		tokensMu.Lock()
+		apiTokens = nil
+		tokensMu.Unlock()
+	}()
+
+	plain, issued, err := issueToken(APIToken{Kind: "personal", Name: "ci", Email: "alice@example.com", Scopes: []string{"wiki.example.com"}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := issueToken(APIToken{Kind: "personal", Name: "laptop", Email: "bob@example.com"}, time.Hour)
+	expired, _, _ := issueToken(APIToken{Kind: "device", Email: "alice@example.com"}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	// Only the hash is stored
+	if issued.Hash != hashToken(plain) || issued.Hash == plain {
+		t.Errorf("stored hash %q", issued.Hash)
+	}
+	stored, err := os.ReadFile(getDataPath("tokens.json"))
+	if err != nil || strings.Contains(string(stored), plain) || !strings.Contains(string(stored), issued.Hash) {
+		t.Errorf("token store %s, %v", stored, err)
+	}
+
+	tests := []struct {
+		plain string
+		email string
+		found bool
+	}{
+		{plain, "alice@example.com", true},
+		{other, "bob@example.com", true},
+		{plain + "x", "", false},
+		{issued.Hash, "", false},
+		{expired, "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		token, found := lookupToken(tt.plain)
+		if found != tt.found || token.Email != tt.email {
+			t.Errorf("%q: found %v for %q, want %v for %q", tt.plain, found, token.Email, tt.found, tt.email)
+		}
+	}
+	if token, _ := lookupToken(plain); token.LastUsed.IsZero() {
+		t.Error("use not recorded")
+	}
+
+	if len(listTokens("alice@example.com")) != 2 || len(listTokens("")) != 3 {
+		t.Errorf("listed %d of alice's and %d in total", len(listTokens("alice@example.com")), len(listTokens("")))
+	}
+	if revokeToken(issued.ID, "bob@example.com") {
+		t.Error("revoked another user's token")
+	}
+	if !revokeToken(issued.ID, "alice@example.com") {
+		t.Error("token not revoked")
+	}
+	if _, found := lookupToken(plain); found {
+		t.Error("revoked token still accepted")
+	}
+	if revokeToken(issued.ID, "") {
+		t.Error("token revoked twice")
+	}
+	if _, found := lookupToken(other); !found {
+		t.Error("other token revoked")
+	}
+}
+
+// useTestProxies serves the proxies by their external and any aliases
+// given, for the rest of the test.
+func useTestProxies(t *testing.T, byName map[string]*ProxyDetails, aliases map[string]string) {
+	byHost := make(map[string]*ProxyDetails)
+	for external, pd := range byName {
+		pd.External = external
+		byHost[external] = pd
+	}
+	for alias, external := range aliases {
+		byHost[alias] = byName[external]
+	}
+	proxiesMu.Lock()
+	savedProxies, savedWildcards, savedByName := proxies, wildcardProxies, proxiesByName
+	proxies, wildcardProxies, proxiesByName = byHost, nil, byName
+	proxiesMu.Unlock()
+	t.Cleanup(func() {
+		proxiesMu.Lock()
+		proxies, wildcardProxies, proxiesByName = savedProxies, savedWildcards, savedByName
+		proxiesMu.Unlock()
+	})
+}
+
+func TestScopeProxy(t *testing.T) {
+	wiki := &ProxyDetails{}
+	useTestProxies(t, map[string]*ProxyDetails{"wiki.example.com": wiki}, map[string]string{"w.example.com": "wiki.example.com"})
+
+	tests := []struct {
+		scope string
+		want  *ProxyDetails
+	}{
+		{"wiki.example.com", wiki},
+		{"w.example.com", wiki},
+		{"docs.example.com", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		pd, found := scopeProxy(tt.scope)
+		if pd != tt.want || found != (tt.want != nil) {
+			t.Errorf("%q: got %v, %v", tt.scope, pd, found)
+		}
+	}
+}
+
+func TestRevokeUnauthorizedTokens(t *testing.T) {
+	chdirTemp(t)
+	useTestProxies(t, map[string]*ProxyDetails{
+		"wiki.example.com": {AllowedUsers: []AllowedUser{{Email: "alice@example.com"}}},
+		"docs.example.com": {AllowedUsers: []AllowedUser{{Email: "alice@example.com"}, {Email: "bob@example.com"}}},
+	}, map[string]string{"w.example.com": "wiki.example.com"})
+	tokensMu.Lock()
+	apiTokens = []*APIToken{
+		{ID: "kept", Email: "alice@example.com", Scopes: []string{"wiki.example.com", "docs.example.com"}},
+		{ID: "alias", Email: "alice@example.com", Scopes: []string{"w.example.com"}},
+		{ID: "unauthorized", Email: "bob@example.com", Scopes: []string{"docs.example.com", "wiki.example.com"}},
+		{ID: "removed proxy", Email: "alice@example.com", Scopes: []string{"gone.example.com"}},
+	}
+	tokensMu.Unlock()
+	defer func() {
+		tokensMu.Lock()
+		apiTokens = nil
+		tokensMu.Unlock()
+	}()
+
+	revokeUnauthorizedTokens()
+
+	tokens := listTokens("")
+	if len(tokens) != 2 || tokens[0].ID != "kept" || tokens[1].ID != "alias" {
+		t.Fatalf("kept %+v", tokens)
+	}
+	if scopes := tokens[1].Scopes; len(scopes) != 1 || scopes[0] != "wiki.example.com" {
+		t.Errorf("alias scope not normalised: %q", scopes)
+	}
+	if stored, err := os.ReadFile(getDataPath("tokens.json")); err != nil || strings.Contains(string(stored), "unauthorized") {
+		t.Errorf("token store %s, %v", stored, err)
+	}
+}
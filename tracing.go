@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Distributed tracing: spans for the login flow and proxied requests, with
+// W3C trace context propagated to upstreams and exported to an OpenTelemetry
+// collector over OTLP/HTTP (JSON encoding).
+
+// Tracing configures span export. Tracing is off unless Endpoint is set.
+type Tracing struct {
+	// OTLP/HTTP traces endpoint, e.g. http://otel-collector:4318/v1/traces
+	Endpoint string `json:"endpoint"`
+	// Extra headers sent to the collector, e.g. for authentication
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"` // defaults to "pylon"
+	// Fraction of new traces recorded, defaults to 1. Requests arriving
+	// with a traceparent follow the caller's sampling decision.
+	SampleRatio *float64 `json:"sample_ratio,omitempty"`
+}
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	traceExportInterval = 5 * time.Second
+	traceBatchSize      = 512
+	traceQueueLimit     = 4096
+)
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	finish   time.Time
+	attrs    map[string]interface{}
+	err      string
+	mu       sync.Mutex
+}
+
+type spanCtxKey struct{}
+
+type traceExporter struct {
+	mu      sync.Mutex
+	conf    *Tracing
+	queue   []*span
+	started bool
+}
+
+var tracer = &traceExporter{}
+
+// configure applies the tracing config, starting the export loop the first
+// time tracing is enabled.
+func (e *traceExporter) configure(conf *Tracing) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if conf != nil && conf.Endpoint == "" {
+		conf = nil
+	}
+	e.conf = conf
+	if conf != nil && !e.started {
+		e.started = true
+		go e.exportLoop()
+	}
+}
+
+func (e *traceExporter) config() *Tracing {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.conf
+}
+
+// spanFromContext returns the current span, or nil when not tracing. All span
+// methods accept a nil span.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanCtxKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the context's span, or a new trace.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return startSpanFrom(ctx, name, kind, [16]byte{}, [8]byte{}, false, false)
+	}
+	return startSpanFrom(ctx, name, kind, parent.traceID, parent.spanID, parent.sampled, true)
+}
+
+func startSpanFrom(ctx context.Context, name string, kind int, traceID [16]byte, parentID [8]byte, sampled bool, hasParent bool) (context.Context, *span) {
+	conf := tracer.config()
+	if conf == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if hasParent {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = conf.SampleRatio == nil || mathrand.Float64() < *conf.SampleRatio
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanCtxKey{}, s), s
+}
+
+// startServerSpan starts the span for an incoming request, continuing the
+// caller's trace when it sent a valid traceparent.
+func startServerSpan(r *http.Request, name string) (*http.Request, *span) {
+	var ctx context.Context
+	var s *span
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx, s = startSpanFrom(r.Context(), name, spanKindServer, traceID, parentID, sampled, true)
+	} else {
+		ctx, s = startSpan(r.Context(), name, spanKindServer)
+	}
+	return r.WithContext(ctx), s
+}
+
+// parseTraceparent parses a W3C traceparent header:
+//
+//	00-<32 hex trace id>-<16 hex parent id>-<2 hex flags>
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// inject sets the traceparent header so the next hop continues this trace.
+func (s *span) inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	h.Set("traceparent", s.traceparent())
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// end finishes the span and queues it for export if sampled.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.finish.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.finish = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		tracer.enqueue(s)
+	}
+}
+
+func (e *traceExporter) enqueue(s *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= traceQueueLimit {
+		return // collector is falling behind; drop rather than grow
+	}
+	e.queue = append(e.queue, s)
+}
+
+func (e *traceExporter) exportLoop() {
+	for range time.Tick(traceExportInterval) {
+		for {
+			e.mu.Lock()
+			conf := e.conf
+			n := len(e.queue)
+			if n > traceBatchSize {
+				n = traceBatchSize
+			}
+			batch := e.queue[:n:n]
+			e.queue = e.queue[n:]
+			e.mu.Unlock()
+
+			if len(batch) == 0 || conf == nil {
+				break
+			}
+			if err := exportSpans(conf, batch); err != nil {
+				log.Printf("Failed to export %d spans: %v", len(batch), err)
+				break
+			}
+		}
+	}
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	list := []otlpAttribute{}
+	for key, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		list = append(list, otlpAttribute{Key: key, Value: value})
+	}
+	return list
+}
+
+// exportSpans POSTs a batch to the collector as an OTLP
+// ExportTraceServiceRequest in JSON.
+func exportSpans(conf *Tracing, batch []*span) error {
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = "pylon"
+	}
+
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.finish.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			out["status"] = map[string]interface{}{"code": 2, "message": s.err}
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "pylon"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", conf.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range conf.Headers {
+		req.Header.Set(key, value)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// serverSpanName keeps span names low-cardinality: Pylon's own endpoints by
+// their first two path segments, e.g. "GET /pylon/callback", and proxied
+// requests by method only.
+func serverSpanName(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/pylon/") {
+		segments := strings.SplitN(r.URL.Path, "/", 4)
+		return r.Method + " /pylon/" + segments[2]
+	}
+	return r.Method
+}
+
+// traceIDFromRequest is the hex trace ID of the request's span, if traced.
+func traceIDFromRequest(r *http.Request) string {
+	s := spanFromContext(r.Context())
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}